@@ -0,0 +1,343 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go"
+	"k8s.io/api/core/v1"
+)
+
+// ArtifactStore keeps the files produced by tasks.
+type ArtifactStore interface {
+	// Put stores size bytes read from r under name.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+
+	// URL returns a link to the artifacts stored under prefix.
+	URL(prefix string) string
+
+	// ServeHTTP serves the artifacts to the links that URL returns.
+	http.Handler
+}
+
+// artifactStore is where artifacts are kept, or nil if they are not.
+var artifactStore ArtifactStore
+
+// newArtifactStore returns the store described by rawurl, which is either
+// file:///some/directory or s3://bucket/prefix.
+func newArtifactStore(rawurl string) (ArtifactStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	links := artifactLinks{
+		BaseURL: strings.TrimSuffix(*artifactURL, "/") + "/artifacts",
+		Key:     []byte(*githubWebhookSecret),
+	}
+	switch u.Scheme {
+	case "file":
+		return &FileArtifactStore{
+			artifactLinks: links,
+			Dir:           u.Path,
+		}, nil
+	case "s3":
+		endpoint, err := url.Parse(*s3Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse s3 endpoint: %v", err)
+		}
+		client, err := minio.New(endpoint.Host,
+			os.Getenv("S3_ACCESS_KEY_ID"),
+			os.Getenv("S3_SECRET_ACCESS_KEY"),
+			endpoint.Scheme == "https")
+		if err != nil {
+			return nil, fmt.Errorf("cannot create s3 client: %v", err)
+		}
+		return &S3ArtifactStore{
+			artifactLinks: links,
+			Client:        client,
+			Bucket:        u.Host,
+			Prefix:        strings.Trim(u.Path, "/"),
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown artifact store %q", rawurl)
+}
+
+// artifactLinks makes and checks the links to the artifacts of a task. The
+// server serves artifacts under /artifacts/, but only through signed links,
+// so that the artifacts of one task can't be found from the link to
+// another's.
+type artifactLinks struct {
+	BaseURL string
+	Key     []byte // signs the links
+}
+
+// artifactLinkLifetime is how long the links to artifacts work.
+const artifactLinkLifetime = 30 * 24 * time.Hour
+
+// URL returns a link to the artifacts stored under prefix, which works for
+// artifactLinkLifetime.
+func (l artifactLinks) URL(prefix string) string {
+	expires := strconv.FormatInt(time.Now().Add(artifactLinkLifetime).Unix(), 10)
+	return l.BaseURL + "/" + prefix + "/?" + url.Values{
+		"expires":   {expires},
+		"signature": {l.sign(prefix, expires)},
+	}.Encode()
+}
+
+func (l artifactLinks) sign(prefix, expires string) string {
+	mac := hmac.New(sha256.New, l.Key)
+	fmt.Fprintf(mac, "%s\n%s", prefix, expires)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// check returns the task prefix and the artifact name of a request signed by
+// URL. The path is the task's prefix, owner/repo/sha/task, followed by the
+// name of an artifact, or by nothing for a list of the task's artifacts. If
+// the request isn't properly signed, check responds to it and returns false.
+func (l artifactLinks) check(w http.ResponseWriter, r *http.Request) (prefix, name string, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"), "/", 5)
+	if len(parts) < 4 {
+		http.NotFound(w, r)
+		return "", "", false
+	}
+	prefix = strings.Join(parts[:4], "/")
+	expires := r.URL.Query().Get("expires")
+	t, err := strconv.ParseInt(expires, 10, 64)
+	signature := r.URL.Query().Get("signature")
+	if err != nil || len(l.Key) == 0 || time.Now().Unix() > t || !hmac.Equal([]byte(signature), []byte(l.sign(prefix, expires))) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return "", "", false
+	}
+	if len(parts) == 5 {
+		name = parts[4]
+	}
+	return prefix, name, true
+}
+
+// writeArtifactList writes a page that links to each of the artifacts in names. The
+// links carry the signature of r along.
+func writeArtifactList(w http.ResponseWriter, r *http.Request, names []string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<pre>\n")
+	for _, name := range names {
+		link := &url.URL{Path: name, RawQuery: r.URL.RawQuery}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()),
+			html.EscapeString(name))
+	}
+	fmt.Fprintf(w, "</pre>\n")
+}
+
+// FileArtifactStore keeps artifacts in a local directory, which would
+// typically be a persistent volume.
+type FileArtifactStore struct {
+	artifactLinks
+	Dir string
+}
+
+func (s *FileArtifactStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if !validArtifactName(name) {
+		return fmt.Errorf("invalid artifact name %q", name)
+	}
+	filename := filepath.Join(s.Dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(f, r, size); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// ServeHTTP serves the artifacts of a task to requests signed by URL.
+func (s *FileArtifactStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix, name, ok := s.check(w, r)
+	if !ok {
+		return
+	}
+
+	dir := filepath.Join(s.Dir, filepath.FromSlash(prefix))
+	if name != "" {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+		return
+	}
+
+	names := []string{}
+	filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(dir, filename)
+		if err != nil {
+			return nil
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	writeArtifactList(w, r, names)
+}
+
+// S3ArtifactStore keeps artifacts in an S3 compatible object store, such as
+// minio. The bucket need not be public: the server lists the artifacts of a
+// task itself, and sends the links to them on to presigned URLs.
+type S3ArtifactStore struct {
+	artifactLinks
+	Client *minio.Client
+	Bucket string
+	Prefix string
+}
+
+// s3PresignLifetime is how long the presigned URLs that the server redirects
+// to work. They are made afresh for each request.
+const s3PresignLifetime = 15 * time.Minute
+
+func (s *S3ArtifactStore) key(name string) string {
+	return strings.TrimPrefix(s.Prefix+"/"+name, "/")
+}
+
+func (s *S3ArtifactStore) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if !validArtifactName(name) {
+		return fmt.Errorf("invalid artifact name %q", name)
+	}
+	_, err := s.Client.PutObjectWithContext(ctx, s.Bucket, s.key(name), r, size,
+		minio.PutObjectOptions{})
+	return err
+}
+
+// ServeHTTP serves the artifacts of a task to requests signed by URL.
+func (s *S3ArtifactStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	prefix, name, ok := s.check(w, r)
+	if !ok {
+		return
+	}
+
+	if name != "" {
+		u, err := s.Client.PresignedGetObject(s.Bucket, s.key(prefix+"/"+name), s3PresignLifetime, nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, u.String(), http.StatusFound)
+		return
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	names := []string{}
+	dir := s.key(prefix) + "/"
+	for object := range s.Client.ListObjectsV2(s.Bucket, dir, true, done) {
+		if object.Err != nil {
+			http.Error(w, object.Err.Error(), http.StatusInternalServerError)
+			return
+		}
+		names = append(names, strings.TrimPrefix(object.Key, dir))
+	}
+	writeArtifactList(w, r, names)
+}
+
+// validArtifactName returns true if name is a clean relative path, so that
+// it can't refer to anything outside the place it is stored in.
+func validArtifactName(name string) bool {
+	return name != "" && name != "." && name == path.Clean(name) && !path.IsAbs(name) &&
+		name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// artifactPrefix returns the name under which the artifacts of task are
+// stored.
+func (b *Builder) artifactPrefix(task TaskConfig) string {
+	return path.Join(b.Owner, b.Repo.GetName(), b.SHA, podNameSafe(task.ID()))
+}
+
+// collectorScript writes a tar file of the files in the workspace that
+// match the patterns given as arguments to stdout.
+const collectorScript = `cd ` + workspaceDir + ` && for f in $* ; do [ -e "$f" ] && echo "$f" ; done | tar -c -f - -T -`
+
+// addArtifacts arranges for collectArtifacts to be able to copy the
+// artifacts of task out of the workspace of pod once the task is done.
+func (b *Builder) addArtifacts(pod *v1.Pod, task TaskConfig) error {
+	if artifactStore == nil {
+		return fmt.Errorf("artifacts are not enabled on this server")
+	}
+	patterns, err := json.Marshal(task.Artifacts)
+	if err != nil {
+		return err
+	}
+	pod.ObjectMeta.Annotations["triggr.crewjam.com/artifacts"] = string(patterns)
+	pod.ObjectMeta.Annotations["triggr.crewjam.com/artifact-prefix"] = b.artifactPrefix(task)
+	collector(pod)
+	return nil
+}
+
+// collectArtifacts copies the files matching the artifact patterns of the
+// task run by pod to the artifact store.
+func collectArtifacts(ctx context.Context, pod *v1.Pod) error {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	patterns := []string{}
+	if err := json.Unmarshal([]byte(annotations["triggr.crewjam.com/artifacts"]), &patterns); err != nil {
+		return fmt.Errorf("cannot parse artifacts: %v", err)
+	}
+	if artifactStore == nil {
+		return fmt.Errorf("artifacts are not enabled on this server")
+	}
+
+	command := append([]string{"/bin/sh", "-c", collectorScript, "--"}, patterns...)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(execInPod(pod, "collector", command, pw))
+	}()
+	defer pr.Close()
+
+	prefix := annotations["triggr.crewjam.com/artifact-prefix"]
+	tr := tar.NewReader(pr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read artifacts: %v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			continue
+		}
+		// the patterns come from the repository, so the names may try to
+		// reach outside the task's prefix
+		name := filepath.ToSlash(filepath.Clean(filepath.FromSlash(hdr.Name)))
+		if !validArtifactName(name) {
+			return fmt.Errorf("invalid artifact name %q", hdr.Name)
+		}
+		if err := artifactStore.Put(ctx, prefix+"/"+name, tr, hdr.Size); err != nil {
+			return fmt.Errorf("cannot store artifact %s: %v", hdr.Name, err)
+		}
+	}
+}
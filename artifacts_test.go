@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidArtifactName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"a/b/sha/task/dist/app", true},
+		{"coverage.out", true},
+		{"dist/..app", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"../etc/passwd", false},
+		{"a/../../etc/passwd", false},
+		{"/etc/passwd", false},
+		{"dist//app", false},
+		{"dist/./app", false},
+	}
+	for _, tt := range tests {
+		if got := validArtifactName(tt.name); got != tt.want {
+			t.Errorf("validArtifactName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFileArtifactStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := &FileArtifactStore{
+		artifactLinks: artifactLinks{BaseURL: "/artifacts", Key: []byte("secret")},
+		Dir:           dir,
+	}
+
+	const prefix = "o/r/0123/test"
+	ctx := context.Background()
+	if err := s.Put(ctx, prefix+"/dist/app", strings.NewReader("hello"), 5); err != nil {
+		t.Fatalf("Put() = %v", err)
+	}
+	if err := s.Put(ctx, prefix+"/../../../../escaped", strings.NewReader("x"), 1); err == nil {
+		t.Errorf("Put() of a name outside the store succeeded")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "escaped")); err == nil {
+		t.Errorf("Put() wrote outside the store")
+	}
+
+	link, err := url.Parse(s.URL(prefix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := link.Query()
+	tests := []struct {
+		name     string
+		path     string
+		query    url.Values
+		wantCode int
+		wantBody string
+	}{
+		{"list", "/" + prefix + "/", signed, http.StatusOK, `<a href="dist/app?`},
+		{"artifact", "/" + prefix + "/dist/app", signed, http.StatusOK, "hello"},
+		{"missing artifact", "/" + prefix + "/dist/nope", signed, http.StatusNotFound, ""},
+		{"unsigned", "/" + prefix + "/dist/app", url.Values{}, http.StatusForbidden, ""},
+		{"other task", "/o/r/0123/lint/dist/app", signed, http.StatusForbidden, ""},
+		{"expired", "/" + prefix + "/dist/app",
+			url.Values{"expires": {"1"}, "signature": {s.sign(prefix, "1")}}, http.StatusForbidden, ""},
+		{"too short", "/o/r/", signed, http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path+"?"+tt.query.Encode(), nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if !strings.Contains(w.Body.String(), tt.wantBody) {
+			t.Errorf("%s: got body %q, want it to contain %q", tt.name, w.Body.String(), tt.wantBody)
+		}
+	}
+}
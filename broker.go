@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+	"goji.io/pat"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The credential broker lets task pods do the few things they need github
+// for without holding a github token. Each task pod gets its own broker
+// token, which is kept in a secret until the pod is finished. With the
+// token, the pod can read its own repository, write its own gist file and
+// set its own status contexts, and nothing else.
+
+// brokerSecretPrefix starts the name of each secret that holds a broker
+// token. The rest of the name is derived from the token.
+const brokerSecretPrefix = "triggr-broker-"
+
+// brokerGrant is what a broker token allows.
+type brokerGrant struct {
+	Owner         string
+	Repo          string
+	SHA           string
+	Gist          string
+	GistFile      string
+	StatusContext string // the context, or a prefix of it followed by "/"
+	TargetURL     string
+}
+
+// brokerURL returns the URL at which task pods reach the broker.
+func brokerURL() string {
+	if *brokerURLFlag == "" {
+		return "http://triggr.default.svc.cluster.local"
+	}
+	return strings.TrimSuffix(*brokerURLFlag, "/")
+}
+
+func brokerSecretName(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return brokerSecretPrefix + hex.EncodeToString(h[:16])
+}
+
+// grantBrokerToken creates a broker token for the pod that runs task, and
+// returns the name of the secret that holds it.
+func (b *Builder) grantBrokerToken(task TaskConfig) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("cannot create broker token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	grant, err := json.Marshal(brokerGrant{
+		Owner:         b.Owner,
+		Repo:          b.Repo.GetName(),
+		SHA:           b.SHA,
+		Gist:          b.Gist.GetID(),
+		GistFile:      task.ID() + " output",
+		StatusContext: b.statusContext(task),
+		TargetURL:     b.TargetURL,
+	})
+	if err != nil {
+		return "", err
+	}
+	secret, err := kubeClient.CoreV1().Secrets(*kubeNamespace).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: brokerSecretName(token),
+			Labels: map[string]string{
+				"triggr-broker": "true",
+				"owner":         b.Owner,
+				"repo":          b.Repo.GetName(),
+			},
+		},
+		StringData: map[string]string{
+			"token": token,
+			"grant": string(grant),
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot create broker secret: %v", err)
+	}
+	return secret.GetName(), nil
+}
+
+// revokeBrokerToken deletes the secret that holds a broker token, so that
+// the token no longer works.
+func revokeBrokerToken(secretName string) {
+	if secretName == "" {
+		return
+	}
+	err := kubeClient.CoreV1().Secrets(*kubeNamespace).Delete(secretName, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		log.Printf("cannot revoke broker token %s: %v", secretName, err)
+	}
+}
+
+// orphanedSecretAge is how old a broker secret has to be before
+// revokeOrphanedTokens deletes it, so that the secrets of pods that are about
+// to be created are left alone.
+const orphanedSecretAge = 10 * time.Minute
+
+// revokeOrphanedTokens deletes the broker secrets that no task pod or Job
+// refers to, which were left behind when the server stopped before it could
+// revoke them. inUse holds the names of the secrets that are referred to.
+func revokeOrphanedTokens(inUse map[string]bool) error {
+	secrets, err := kubeClient.CoreV1().Secrets(*kubeNamespace).List(metav1.ListOptions{
+		LabelSelector: "triggr-broker=true",
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list broker secrets: %v", err)
+	}
+	for _, secret := range secrets.Items {
+		if inUse[secret.GetName()] || time.Since(secret.CreationTimestamp.Time) < orphanedSecretAge {
+			continue
+		}
+		log.Printf("revoking orphaned broker token %s", secret.GetName())
+		revokeBrokerToken(secret.GetName())
+	}
+	return nil
+}
+
+// addBrokerEnv tells the exec and checkout containers of pod how to reach
+// the broker with the token in secretName. The token is added first so that
+// GIT_CLONE_URL can refer to it.
+func (b *Builder) addBrokerEnv(pod *v1.Pod, secretName string) {
+	env := []v1.EnvVar{
+		{
+			Name:  "TRIGGR_BROKER_URL",
+			Value: brokerURL() + "/broker",
+		},
+		{
+			Name: "TRIGGR_TOKEN",
+			ValueFrom: &v1.EnvVarSource{
+				SecretKeyRef: &v1.SecretKeySelector{
+					LocalObjectReference: v1.LocalObjectReference{Name: secretName},
+					Key:                  "token",
+				},
+			},
+		},
+		{
+			Name:  "GIT_CLONE_URL",
+			Value: b.cloneURL(),
+		},
+	}
+	pod.Spec.Containers[0].Env = append(env, pod.Spec.Containers[0].Env...)
+	for i, container := range pod.Spec.InitContainers {
+		if container.Name == "checkout" {
+			pod.Spec.InitContainers[i].Env = append(env, container.Env...)
+		}
+	}
+}
+
+// brokerGrantFor returns the grant of the broker token in r, which is passed
+// either as a bearer token or as the username or password of basic auth.
+func brokerGrantFor(r *http.Request) (*brokerGrant, error) {
+	token := ""
+	if username, password, ok := r.BasicAuth(); ok {
+		token = password
+		if token == "" {
+			token = username
+		}
+	} else if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no token")
+	}
+
+	secret, err := kubeClient.CoreV1().Secrets(*kubeNamespace).Get(brokerSecretName(token), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid token")
+	}
+	if string(secret.Data["token"]) != token {
+		return nil, fmt.Errorf("invalid token")
+	}
+	grant := brokerGrant{}
+	if err := json.Unmarshal(secret.Data["grant"], &grant); err != nil {
+		return nil, fmt.Errorf("cannot parse grant: %v", err)
+	}
+	return &grant, nil
+}
+
+// brokerHandler wraps a broker endpoint so that it is only called with a
+// valid token.
+func brokerHandler(f func(w http.ResponseWriter, r *http.Request, grant *brokerGrant)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		grant, err := brokerGrantFor(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="triggr"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		f(w, r, grant)
+	})
+}
+
+// handleBrokerGit passes the requests git makes to fetch the repository on
+// to github. Nothing that would push is let through.
+func handleBrokerGit(w http.ResponseWriter, r *http.Request, grant *brokerGrant) {
+	owner := pat.Param(r, "owner")
+	repo := strings.TrimSuffix(pat.Param(r, "repo"), ".git")
+	if !strings.EqualFold(owner, grant.Owner) || !strings.EqualFold(repo, grant.Repo) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/broker/git/"+pat.Param(r, "owner")+"/"+pat.Param(r, "repo"))
+	switch {
+	case r.Method == "GET" && path == "/info/refs" && r.URL.Query().Get("service") == "git-upload-pack":
+	case r.Method == "POST" && path == "/git-upload-pack":
+	case r.Method == "POST" && path == "/info/lfs/objects/batch":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batch := struct{ Operation string }{}
+		if err := json.Unmarshal(body, &batch); err != nil || batch.Operation != "download" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	token, err := repoToken(r.Context(), grant.Owner, grant.Repo)
+	if err != nil {
+		log.Printf("broker: %v", err)
+		http.Error(w, "cannot get token", http.StatusBadGateway)
+		return
+	}
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = "https"
+			req.URL.Host = "github.com"
+			req.URL.Path = fmt.Sprintf("/%s/%s.git%s", grant.Owner, grant.Repo, path)
+			req.Host = "github.com"
+			req.SetBasicAuth("x-access-token", token)
+		},
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// handleBrokerGist replaces the content of the pod's gist file with the
+// request body.
+func handleBrokerGist(w http.ResponseWriter, r *http.Request, grant *brokerGrant) {
+	if githubClient == nil || grant.Gist == "" {
+		http.Error(w, "there is no gist for this task", http.StatusNotFound)
+		return
+	}
+	content, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	_, _, err = githubClient.Gists.Edit(r.Context(), grant.Gist, &github.Gist{
+		Files: map[github.GistFilename]github.GistFile{
+			github.GistFilename(grant.GistFile): github.GistFile{
+				Type:    github.String("text/plain"),
+				Content: github.String(string(content)),
+			},
+		},
+	})
+	if err != nil {
+		log.Printf("broker: cannot save gist: %v", err)
+		http.Error(w, "cannot save gist", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleBrokerStatus sets a status on the revision being built. The context
+// must be the task's own, or start with it followed by a slash. If the
+// request doesn't give a context, the task's own is used.
+func handleBrokerStatus(w http.ResponseWriter, r *http.Request, grant *brokerGrant) {
+	status := github.RepoStatus{}
+	if err := json.NewDecoder(r.Body).Decode(&status); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if status.Context == nil {
+		status.Context = github.String(grant.StatusContext)
+	}
+	if c := status.GetContext(); c != grant.StatusContext && !strings.HasPrefix(c, grant.StatusContext+"/") {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if status.TargetURL == nil {
+		status.TargetURL = github.String(grant.TargetURL)
+	}
+	status.Description = github.String(truncateDescription(status.GetDescription()))
+
+	if err := setBrokerStatus(r.Context(), grant, &status); err != nil {
+		log.Printf("broker: %v", err)
+		http.Error(w, "cannot set status", http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func setBrokerStatus(ctx context.Context, grant *brokerGrant, status *github.RepoStatus) error {
+	client, err := repoClient(ctx, grant.Owner, grant.Repo)
+	if err != nil {
+		return err
+	}
+	if _, _, err := client.Repositories.CreateStatus(ctx, grant.Owner, grant.Repo, grant.SHA, status); err != nil {
+		return fmt.Errorf("cannot create status: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+	"goji.io"
+	"goji.io/pat"
+	"k8s.io/api/core/v1"
+)
+
+func TestBrokerSecretName(t *testing.T) {
+	a, b := brokerSecretName("token-a"), brokerSecretName("token-b")
+	if a == b {
+		t.Errorf("brokerSecretName() gave %s for two tokens", a)
+	}
+	if !strings.HasPrefix(a, brokerSecretPrefix) || len(a) > 63 {
+		t.Errorf("brokerSecretName() = %s", a)
+	}
+	if strings.Contains(a, "token-a") {
+		t.Errorf("brokerSecretName() = %s, which gives the token away", a)
+	}
+}
+
+func TestHandleBrokerGitForbidden(t *testing.T) {
+	grant := &brokerGrant{Owner: "crewjam", Repo: "triggr"}
+	mux := goji.NewMux()
+	handler := func(w http.ResponseWriter, r *http.Request) { handleBrokerGit(w, r, grant) }
+	mux.HandleFunc(pat.Get("/broker/git/:owner/:repo/*"), handler)
+	mux.HandleFunc(pat.Post("/broker/git/:owner/:repo/*"), handler)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+	}{
+		{"other repository", "GET", "/broker/git/crewjam/saml.git/info/refs?service=git-upload-pack", ""},
+		{"other owner", "GET", "/broker/git/other/triggr.git/info/refs?service=git-upload-pack", ""},
+		{"push refs", "GET", "/broker/git/crewjam/triggr.git/info/refs?service=git-receive-pack", ""},
+		{"push", "POST", "/broker/git/crewjam/triggr.git/git-receive-pack", ""},
+		{"lfs upload", "POST", "/broker/git/crewjam/triggr.git/info/lfs/objects/batch", `{"operation": "upload"}`},
+		{"lfs garbage", "POST", "/broker/git/crewjam/triggr.git/info/lfs/objects/batch", `{`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestHandleBrokerStatus(t *testing.T) {
+	var got *github.RepoStatus
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/crewjam/triggr/statuses/0123" {
+			http.NotFound(w, r)
+			return
+		}
+		got = &github.RepoStatus{}
+		json.NewDecoder(r.Body).Decode(got)
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	oldClient := githubClient
+	defer func() { githubClient = oldClient }()
+	githubClient = github.NewClient(nil)
+	githubClient.BaseURL, _ = url.Parse(server.URL + "/")
+
+	grant := &brokerGrant{
+		Owner:         "crewjam",
+		Repo:          "triggr",
+		SHA:           "0123",
+		StatusContext: "triggr/test",
+		TargetURL:     "https://example.com/gist",
+	}
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    int
+		wantContext string
+	}{
+		{"own context", `{"state": "success", "context": "triggr/test"}`, http.StatusNoContent, "triggr/test"},
+		{"no context", `{"state": "success"}`, http.StatusNoContent, "triggr/test"},
+		{"sub-context", `{"state": "failure", "context": "triggr/test/coverage"}`, http.StatusNoContent, "triggr/test/coverage"},
+		{"other task", `{"state": "success", "context": "triggr/lint"}`, http.StatusForbidden, ""},
+		{"prefix of another", `{"state": "success", "context": "triggr/test-race"}`, http.StatusForbidden, ""},
+		{"garbage", `{`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		got = nil
+		r := httptest.NewRequest("POST", "/broker/status", strings.NewReader(tt.body))
+		w := httptest.NewRecorder()
+		handleBrokerStatus(w, r, grant)
+		if w.Code != tt.wantCode {
+			t.Errorf("%s: got status %d, want %d", tt.name, w.Code, tt.wantCode)
+		}
+		if tt.wantContext == "" {
+			if got != nil {
+				t.Errorf("%s: status was set", tt.name)
+			}
+			continue
+		}
+		if got == nil {
+			t.Errorf("%s: status was not set", tt.name)
+			continue
+		}
+		if got.GetContext() != tt.wantContext || got.GetTargetURL() != grant.TargetURL {
+			t.Errorf("%s: got context %q and target %q", tt.name, got.GetContext(), got.GetTargetURL())
+		}
+	}
+}
+
+func TestAddBrokerEnv(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{
+		InitContainers: []v1.Container{{Name: "checkout"}, {Name: "cache-restore"}},
+		Containers:     []v1.Container{{Name: "exec", Env: []v1.EnvVar{{Name: "TRIGGR", Value: "true"}}}},
+	}}
+	b := &Builder{Repo: &github.Repository{FullName: github.String("crewjam/triggr")}}
+	b.addBrokerEnv(pod, "triggr-broker-0123")
+
+	tests := []struct {
+		container v1.Container
+		want      bool
+	}{
+		{pod.Spec.InitContainers[0], true},
+		{pod.Spec.InitContainers[1], false},
+		{pod.Spec.Containers[0], true},
+	}
+	for _, tt := range tests {
+		env := map[string]v1.EnvVar{}
+		for _, e := range tt.container.Env {
+			env[e.Name] = e
+		}
+		token, ok := env["TRIGGR_TOKEN"]
+		if ok != tt.want {
+			t.Errorf("%s has a broker token: %v, want %v", tt.container.Name, ok, tt.want)
+			continue
+		}
+		if ok && (token.ValueFrom == nil || token.ValueFrom.SecretKeyRef.Name != "triggr-broker-0123") {
+			t.Errorf("%s gets its broker token from %v", tt.container.Name, token.ValueFrom)
+		}
+	}
+	if env := pod.Spec.Containers[0].Env; env[len(env)-1].Name != "TRIGGR" {
+		t.Errorf("exec lost its environment: %v", env)
+	}
+}
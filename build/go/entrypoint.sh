@@ -19,7 +19,13 @@ if [ -z "$SOURCE_DIR" ] ; then
     SOURCE_DIR=${SOURCE_DIR-/src}
 fi
 
-if [ ! -z "$GIT_CLONE_URL" ] ; then
+if [ -d "$WORKSPACE/.git" ] ; then
+    # triggr already checked out the source
+    if [ "$SOURCE_DIR" != "$WORKSPACE" ] ; then
+        mkdir -p $(dirname $SOURCE_DIR)
+        ln -s $WORKSPACE $SOURCE_DIR
+    fi
+elif [ ! -z "$GIT_CLONE_URL" ] ; then
     (set -x; git clone $GIT_CLONE_URL $SOURCE_DIR)
     if [ ! -z "$GIT_REF" ] ; then
         git -C $SOURCE_DIR fetch origin +$GIT_REF:
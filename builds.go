@@ -0,0 +1,383 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// maxBuildPrefix is the longest prefix of a generated Build name. The name
+// goes in the build label of its TaskRuns, which can be at most 63
+// characters, and kubernetes adds 5 random ones after the dash.
+const maxBuildPrefix = 63 - 6
+
+// maxTaskRunName is the longest name a TaskRun can have.
+const maxTaskRunName = 253
+
+// recordBuild records the build in a Build, with a TaskRun for each of its
+// tasks, before any of the tasks start. Nothing is recorded if the resources
+// are not installed.
+func (b *Builder) recordBuild() error {
+	if !crdsInstalled {
+		return nil
+	}
+	labels := map[string]string{
+		"owner": b.Owner,
+		"repo":  b.Repo.GetName(),
+		"sha":   b.SHA,
+	}
+	now := metav1.Now()
+	build, err := postBuild(&Build{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: b.buildNamePrefix(),
+			Labels:       buildLabels(labels, phaseRunning),
+		},
+		Spec: BuildSpec{
+			Owner:       b.Owner,
+			Repo:        b.Repo.GetName(),
+			Event:       b.Event,
+			SHA:         b.SHA,
+			Ref:         b.Ref,
+			PullRequest: b.PullRequest.GetNumber(),
+			Only:        b.Only,
+			Manual:      b.Manual,
+			Trusted:     b.Trusted,
+			Gist:        b.Gist.GetID(),
+			TargetURL:   b.TargetURL,
+			Config:      b.Config,
+		},
+		Status: BuildStatus{
+			Phase:     phaseRunning,
+			StartTime: &now,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot create build: %v", err)
+	}
+	b.BuildName = build.GetName()
+
+	for _, task := range b.Config.Tasks {
+		taskRunLabels := map[string]string{"build": build.GetName()}
+		for k, v := range labels {
+			taskRunLabels[k] = v
+		}
+		_, err := postTaskRun(&TaskRun{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   b.taskRunName(task),
+				Labels: taskRunLabels,
+				OwnerReferences: []metav1.OwnerReference{
+					crdOwnerReference("Build", build.GetName(), build.GetUID()),
+				},
+			},
+			Spec: TaskRunSpec{
+				Build:         build.GetName(),
+				Task:          task.ID(),
+				StatusContext: b.statusContext(task),
+			},
+			Status: TaskRunStatus{
+				Phase:  phasePending,
+				LogURL: b.TargetURL,
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("cannot create task run: %v", err)
+		}
+	}
+	return nil
+}
+
+// buildNamePrefix returns the prefix of the generated name of the Build.
+func (b *Builder) buildNamePrefix() string {
+	return truncateName(podNameSafe(b.Owner+"-"+b.Repo.GetName()), maxBuildPrefix) + "-"
+}
+
+// buildLabels returns the labels of a Build in phase. The phase label lets
+// the server find the running and the finished builds without listing them
+// all.
+func buildLabels(labels map[string]string, phase string) map[string]string {
+	rv := map[string]string{"phase": phase}
+	for k, v := range labels {
+		rv[k] = v
+	}
+	return rv
+}
+
+// taskRunName returns the name of the TaskRun that records task, or "" if
+// the builder doesn't know its Build.
+func (b *Builder) taskRunName(task TaskConfig) string {
+	if b.BuildName == "" {
+		return ""
+	}
+	return truncateName(b.BuildName+"-"+podNameSafe(b.taskKey(task)), maxTaskRunName)
+}
+
+// builderFromBuild returns the Builder for the build recorded in build.
+func builderFromBuild(build *Build) *Builder {
+	spec := build.Spec
+	b := &Builder{
+		Repo: &github.Repository{
+			Name:     github.String(spec.Repo),
+			FullName: github.String(spec.Owner + "/" + spec.Repo),
+		},
+		Event:     spec.Event,
+		SHA:       spec.SHA,
+		Ref:       spec.Ref,
+		Owner:     spec.Owner,
+		Config:    spec.Config,
+		Gist:      &github.Gist{ID: github.String(spec.Gist)},
+		TargetURL: spec.TargetURL,
+		Only:      spec.Only,
+		Manual:    spec.Manual,
+		Trusted:   spec.Trusted,
+		BuildName: build.GetName(),
+	}
+	if spec.PullRequest != 0 {
+		b.PullRequest = &github.PullRequest{Number: github.Int(spec.PullRequest)}
+	}
+	return b
+}
+
+// taskRunPhase returns the phase of a task whose github status is state
+// with description.
+func taskRunPhase(state, description string) string {
+	switch {
+	case state == "success" && strings.HasPrefix(description, "skipped"):
+		return phaseSkipped
+	case state == "success":
+		return phaseSucceeded
+	case state == "failure":
+		return phaseFailed
+	case state == "error":
+		return phaseError
+	case strings.HasPrefix(description, "queued"):
+		return phaseQueued
+	case description == awaitingApproval:
+		return phaseAwaitingApproval
+	default:
+		return phaseRunning
+	}
+}
+
+// finishedPhase returns true if a task in phase has finished.
+func finishedPhase(phase string) bool {
+	switch phase {
+	case phaseSucceeded, phaseSkipped, phaseFailed, phaseError:
+		return true
+	}
+	return false
+}
+
+// setState updates s for the github status state with description. The
+// times are when the task started and finished, or zero if they aren't known,
+// in which case the time of the update is used.
+func (s *TaskRunStatus) setState(state, description string, startedAt, completedAt time.Time) {
+	s.Phase = taskRunPhase(state, description)
+	s.State = state
+	s.Description = description
+	if s.Phase == phaseRunning && s.StartTime == nil {
+		if startedAt.IsZero() {
+			startedAt = time.Now()
+		}
+		s.StartTime = &metav1.Time{Time: startedAt}
+	}
+	if finishedPhase(s.Phase) && s.CompletionTime == nil {
+		if completedAt.IsZero() {
+			completedAt = time.Now()
+		}
+		s.CompletionTime = &metav1.Time{Time: completedAt}
+	}
+}
+
+// recordTaskState records the github status of task in its TaskRun.
+func (b *Builder) recordTaskState(task TaskConfig, state, description string) error {
+	return b.updateTaskRuns(task, func(s *TaskRunStatus) {
+		s.setState(state, description, time.Time{}, time.Time{})
+	})
+}
+
+// updateTaskRuns applies update to the status of the TaskRun of task. A
+// builder that doesn't know its Build, such as one that cancels the tasks of
+// an earlier event, updates the unfinished TaskRuns of the task at the
+// revision being built instead.
+func (b *Builder) updateTaskRuns(task TaskConfig, update func(s *TaskRunStatus)) error {
+	if !crdsInstalled {
+		return nil
+	}
+	names := []string{}
+	if name := b.taskRunName(task); name != "" {
+		names = append(names, name)
+	} else {
+		taskRuns, err := listTaskRuns(fmt.Sprintf("owner=%s,repo=%s,sha=%s",
+			b.Owner, b.Repo.GetName(), b.SHA))
+		if err != nil {
+			return fmt.Errorf("cannot list task runs: %v", err)
+		}
+		for _, taskRun := range taskRuns.Items {
+			if taskRun.Spec.StatusContext == b.statusContext(task) && !finishedPhase(taskRun.Status.Phase) {
+				names = append(names, taskRun.GetName())
+			}
+		}
+	}
+	for _, name := range names {
+		if err := updateTaskRunStatus(name, update); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordPodState records the github status of the task run by pod in its
+// TaskRun, with the times that the pod started and finished.
+func recordPodState(pod *v1.Pod, state, description string) error {
+	name := pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/task-run"]
+	if name == "" {
+		return nil
+	}
+	startedAt, completedAt := podTimes(pod)
+	return updateTaskRunStatus(name, func(s *TaskRunStatus) {
+		s.Pod = pod.GetName()
+		s.setState(state, description, startedAt, completedAt)
+	})
+}
+
+// recordTaskCreated records in the TaskRun called name whether the pod or
+// Job of the current attempt at its task has been created. A task that was
+// created and has no pod has been lost, while one that wasn't can be started
+// again.
+func recordTaskCreated(name string, created bool) error {
+	if name == "" {
+		return nil
+	}
+	return updateTaskRunStatus(name, func(s *TaskRunStatus) {
+		s.Created = created
+	})
+}
+
+// updateTaskRunStatus applies update to the status of the TaskRun called
+// name. When that finishes the task, the Build is finished too if it was the
+// last of its tasks.
+func updateTaskRunStatus(name string, update func(s *TaskRunStatus)) error {
+	var build string
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		taskRun, err := getTaskRun(name)
+		if err != nil {
+			return err
+		}
+		wasFinished := finishedPhase(taskRun.Status.Phase)
+		update(&taskRun.Status)
+		if _, err := putTaskRun(taskRun); err != nil {
+			return err
+		}
+		if !wasFinished && finishedPhase(taskRun.Status.Phase) {
+			build = taskRun.Spec.Build
+		}
+		return nil
+	})
+	if apierrors.IsNotFound(err) {
+		return nil // the build has been deleted
+	}
+	if err != nil {
+		return fmt.Errorf("cannot update task run %s: %v", name, err)
+	}
+	if build != "" {
+		return finishBuild(build)
+	}
+	return nil
+}
+
+// finishBuild marks the Build called name as Succeeded or Failed once all of
+// its TaskRuns have finished.
+func finishBuild(name string) error {
+	taskRuns, err := listTaskRuns("build=" + name)
+	if err != nil {
+		return fmt.Errorf("cannot list task runs: %v", err)
+	}
+	phase := phaseSucceeded
+	for _, taskRun := range taskRuns.Items {
+		switch {
+		case !finishedPhase(taskRun.Status.Phase):
+			return nil
+		case taskRun.Status.Phase == phaseFailed, taskRun.Status.Phase == phaseError:
+			phase = phaseFailed
+		}
+	}
+
+	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		build, err := getBuild(name)
+		if err != nil {
+			return err
+		}
+		if build.Status.Phase != phaseRunning {
+			return nil
+		}
+		now := metav1.Now()
+		build.Status.Phase = phase
+		build.Status.CompletionTime = &now
+		build.Labels = buildLabels(build.Labels, phase)
+		_, err = putBuild(build)
+		return err
+	})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot update build %s: %v", name, err)
+	}
+	return nil
+}
+
+// buildRetention returns how long finished builds are kept, or zero if they
+// are kept forever.
+func buildRetention() (time.Duration, error) {
+	if *buildRetentionFlag == "" {
+		return 30 * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(*buildRetentionFlag)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -build-retention: %v", err)
+	}
+	return d, nil
+}
+
+// runBuildCollector deletes the builds that finished longer ago than
+// -build-retention, along with their TaskRuns, once an hour.
+func runBuildCollector() {
+	retention, _ := buildRetention()
+	if retention == 0 || !crdsInstalled {
+		return
+	}
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		if err := collectBuilds(retention); err != nil {
+			log.Printf("collectBuilds: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// collectBuilds deletes the builds that finished longer than retention ago.
+func collectBuilds(retention time.Duration) error {
+	builds, err := listBuilds(fmt.Sprintf("phase in (%s,%s)", phaseSucceeded, phaseFailed))
+	if err != nil {
+		return fmt.Errorf("cannot list builds: %v", err)
+	}
+	for _, build := range builds.Items {
+		completed := build.Status.CompletionTime
+		if completed == nil || time.Since(completed.Time) < retention {
+			continue
+		}
+		err := deleteBuild(build.GetName())
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("cannot delete build %s: %v", build.GetName(), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+)
+
+func TestTaskRunPhase(t *testing.T) {
+	tests := []struct {
+		state       string
+		description string
+		want        string
+	}{
+		{"success", "success", phaseSucceeded},
+		{"success", "skipped: no relevant changes", phaseSkipped},
+		{"failure", "exit code 1", phaseFailed},
+		{"error", "timed out after 30m0s", phaseError},
+		{"pending", "queued (position 3)", phaseQueued},
+		{"pending", awaitingApproval, phaseAwaitingApproval},
+		{"pending", "started", phaseRunning},
+		{"pending", waitingPrefix + "lint", phaseRunning}, // set directly by waitTask
+	}
+	for _, tt := range tests {
+		if got := taskRunPhase(tt.state, tt.description); got != tt.want {
+			t.Errorf("taskRunPhase(%q, %q) = %s, want %s", tt.state, tt.description, got, tt.want)
+		}
+	}
+}
+
+func TestTaskRunName(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name      string
+		buildName string
+		task      TaskConfig
+		want      string
+	}{
+		{"no build", "", TaskConfig{Name: "test"}, ""},
+		{"short", "crewjam-triggr-x7k2p", TaskConfig{Name: "test"}, "crewjam-triggr-x7k2p-test"},
+		{"variant", "crewjam-triggr-x7k2p",
+			TaskConfig{Name: "Test", Variant: map[string]string{"go": "1.21"}},
+			"crewjam-triggr-x7k2p-test-1.21"},
+		{"long", "crewjam-triggr-x7k2p", TaskConfig{Name: long},
+			truncateName("crewjam-triggr-x7k2p-"+long, maxTaskRunName)},
+	}
+	for _, tt := range tests {
+		b := &Builder{Event: "push", BuildName: tt.buildName}
+		got := b.taskRunName(tt.task)
+		if got != tt.want {
+			t.Errorf("%s: taskRunName() = %q, want %q", tt.name, got, tt.want)
+		}
+		if len(got) > maxTaskRunName {
+			t.Errorf("%s: taskRunName() is %d characters long", tt.name, len(got))
+		}
+	}
+}
+
+func TestBuildNamePrefix(t *testing.T) {
+	tests := []struct {
+		owner string
+		repo  string
+	}{
+		{"crewjam", "triggr"},
+		{strings.Repeat("o", 39), strings.Repeat("r", 100)},
+	}
+	for _, tt := range tests {
+		b := &Builder{Owner: tt.owner, Repo: &github.Repository{Name: github.String(tt.repo)}}
+		// the API server adds five random characters
+		if name := b.buildNamePrefix() + "xxxxx"; len(name) > 63 {
+			t.Errorf("%s/%s: build name %q is too long for a label", tt.owner, tt.repo, name)
+		}
+	}
+}
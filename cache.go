@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/google/go-github/v39/github"
+	"k8s.io/api/core/v1"
+)
+
+// CacheConfig describes a set of directories that are kept from one build to
+// the next.
+type CacheConfig struct {
+	Key   string   // template for the name of the cache
+	Paths []string // directories to cache
+}
+
+// cacheDir is where the cache volume is mounted in the helper containers.
+const cacheDir = "/cache"
+
+// cachePath returns where the helper containers see the j'th path of the
+// i'th cache of a task.
+func cachePath(i, j int) string {
+	return fmt.Sprintf("/cache-paths/%d/%d", i, j)
+}
+
+// cacheKey evaluates the key template of a cache. The template can use the
+// hash function to include a digest of files in the repository, e.g.
+//
+//	go-{{ hash "go.sum" }}
+//
+// The key is made safe to use as a directory name. Keys that come out empty,
+// or that start with a dot like the temporary directories of cacheSaveScript,
+// are refused.
+func (b *Builder) cacheKey(ctx context.Context, key string) (string, error) {
+	t, err := template.New("key").Funcs(template.FuncMap{
+		"hash": func(filenames ...string) (string, error) {
+			h := sha256.New()
+			for _, filename := range filenames {
+				content, err := b.fileContent(ctx, filename)
+				if err != nil {
+					return "", err
+				}
+				h.Write([]byte(content))
+			}
+			return hex.EncodeToString(h.Sum(nil))[:16], nil
+		},
+	}).Parse(key)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse cache key: %v", err)
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := t.Execute(buf, nil); err != nil {
+		return "", fmt.Errorf("cannot evaluate cache key: %v", err)
+	}
+	name := podNameSafe(buf.String())
+	if name == "" || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid cache key %q", buf.String())
+	}
+	return name, nil
+}
+
+// fileContent returns the content of a file in the revision being built.
+func (b *Builder) fileContent(ctx context.Context, filename string) (string, error) {
+	client, err := b.client(ctx)
+	if err != nil {
+		return "", err
+	}
+	fileContent, _, _, err := client.Repositories.GetContents(ctx,
+		b.Owner,
+		b.Repo.GetName(),
+		filename,
+		&github.RepositoryContentGetOptions{
+			Ref: b.SHA,
+		})
+	if err != nil {
+		return "", fmt.Errorf("cannot fetch %s: %v", filename, err)
+	}
+	content, err := fileContent.GetContent()
+	if err != nil {
+		return "", fmt.Errorf("cannot decode %s: %v", filename, err)
+	}
+	return content, nil
+}
+
+// addCaches arranges for the cached directories of task to be restored
+// before the task starts, and for saveCaches to be able to save them when it
+// is done.
+//
+// Caches live on the persistent volume claim named by -cache-claim, under a
+// directory for each repository. Each cached directory is an empty dir volume
+// that is mounted in the exec container at the cached path, and in the helper
+// containers at cachePath, from where it is copied to and from the claim.
+//
+// Untrusted builds restore caches but don't save them, so that they can't
+// put anything in the caches of later trusted builds.
+func (b *Builder) addCaches(ctx context.Context, pod *v1.Pod, task TaskConfig) error {
+	if *cacheClaim == "" {
+		return fmt.Errorf("caches are not enabled on this server")
+	}
+	caches := []CacheConfig{}
+	for _, cache := range task.Cache {
+		key, err := b.cacheKey(ctx, cache.Key)
+		if err != nil {
+			return err
+		}
+		caches = append(caches, CacheConfig{Key: key, Paths: cache.Paths})
+	}
+	if b.Trusted {
+		cachesJSON, err := json.Marshal(caches)
+		if err != nil {
+			return err
+		}
+		pod.ObjectMeta.Annotations["triggr.crewjam.com/cache"] = string(cachesJSON)
+	}
+
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: "cache",
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{
+				ClaimName: *cacheClaim,
+			},
+		},
+	})
+	cacheMount := v1.VolumeMount{
+		Name:      "cache",
+		MountPath: cacheDir,
+		SubPath:   path.Join(b.Owner, b.Repo.GetName()),
+	}
+	restore := v1.Container{
+		Name:         "cache-restore",
+		Image:        helperImageName(),
+		Command:      []string{"/bin/sh", "-c", cacheRestoreScript(caches)},
+		VolumeMounts: []v1.VolumeMount{cacheMount},
+	}
+	if b.Trusted {
+		collector(pod).VolumeMounts = append(collector(pod).VolumeMounts, cacheMount)
+	}
+
+	for i, cache := range caches {
+		for j, cachedPath := range cache.Paths {
+			volumeName := fmt.Sprintf("cache-%d-%d", i, j)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+				Name: volumeName,
+				VolumeSource: v1.VolumeSource{
+					EmptyDir: &v1.EmptyDirVolumeSource{},
+				},
+			})
+			pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, v1.VolumeMount{
+				Name:      volumeName,
+				MountPath: cachedPath,
+			})
+			helperMount := v1.VolumeMount{
+				Name:      volumeName,
+				MountPath: cachePath(i, j),
+			}
+			restore.VolumeMounts = append(restore.VolumeMounts, helperMount)
+			if b.Trusted {
+				collector(pod).VolumeMounts = append(collector(pod).VolumeMounts, helperMount)
+			}
+		}
+	}
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, restore)
+	return nil
+}
+
+// cacheRestoreScript returns a script that copies each cache that has been
+// saved into the volumes for its paths.
+func cacheRestoreScript(caches []CacheConfig) string {
+	buf := bytes.NewBufferString("set -e\n")
+	for i, cache := range caches {
+		dir := path.Join(cacheDir, cache.Key)
+		fmt.Fprintf(buf, "if [ -d %q ] ; then\n", dir)
+		fmt.Fprintf(buf, "    echo restoring cache %s\n", cache.Key)
+		for j := range cache.Paths {
+			fmt.Fprintf(buf, "    cp -a %q %q\n", fmt.Sprintf("%s/%d/.", dir, j), cachePath(i, j))
+		}
+		fmt.Fprintf(buf, "fi\n")
+	}
+	return buf.String()
+}
+
+// cacheSaveScript returns a script that saves each cache that hasn't been
+// saved yet. Caches are written to a temporary directory of the pod's own
+// first, so that a partly saved cache is never restored, and then renamed into
+// place. If another pod saved the same cache in the meantime, the rename puts
+// the temporary directory inside the saved cache instead, and it is removed.
+func cacheSaveScript(caches []CacheConfig) string {
+	buf := bytes.NewBufferString("set -e\n")
+	for i, cache := range caches {
+		dir := path.Join(cacheDir, cache.Key)
+		tmpName := ".tmp-" + cache.Key + "-$HOSTNAME"
+		tmp := path.Join(cacheDir, tmpName)
+		fmt.Fprintf(buf, "if [ ! -d %q ] ; then\n", dir)
+		fmt.Fprintf(buf, "    rm -rf %q\n", tmp)
+		fmt.Fprintf(buf, "    mkdir -p %q\n", tmp)
+		for j := range cache.Paths {
+			fmt.Fprintf(buf, "    cp -a %q %q\n", cachePath(i, j), fmt.Sprintf("%s/%d", tmp, j))
+		}
+		fmt.Fprintf(buf, "    mv %q %q\n", tmp, dir)
+		fmt.Fprintf(buf, "    rm -rf %q\n", path.Join(dir, tmpName))
+		fmt.Fprintf(buf, "fi\n")
+	}
+	return buf.String()
+}
+
+// saveCaches saves the caches of the task run by pod, which has just
+// succeeded.
+func saveCaches(pod *v1.Pod) error {
+	caches := []CacheConfig{}
+	err := json.Unmarshal([]byte(pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/cache"]), &caches)
+	if err != nil {
+		return fmt.Errorf("cannot parse caches: %v", err)
+	}
+	command := []string{"/bin/sh", "-c", cacheSaveScript(caches)}
+	if err := execInPod(pod, "collector", command, ioutil.Discard); err != nil {
+		return fmt.Errorf("cannot save caches: %v", err)
+	}
+	return nil
+}
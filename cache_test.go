@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		want    string
+		wantErr bool
+	}{
+		{"go-mod", "go-mod", false},
+		{"Node Modules", "node-modules", false},
+		{"deps-{{ \"v2\" }}", "deps-v2", false},
+		{"{{ if false }}x{{ end }}", "", true},
+		{"..", "", true},
+		{".tmp-go", "", true},
+		{"{{ bad", "", true},
+	}
+	b := &Builder{}
+	for _, tt := range tests {
+		got, err := b.cacheKey(context.Background(), tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("cacheKey(%q) error = %v, want error %v", tt.key, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("cacheKey(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestCacheScripts(t *testing.T) {
+	caches := []CacheConfig{
+		{Key: "go-0123", Paths: []string{"/root/go/pkg/mod", "/root/.cache/go-build"}},
+		{Key: "npm", Paths: []string{"/workspace/node_modules"}},
+	}
+	tests := []struct {
+		name   string
+		script string
+		want   []string
+	}{
+		{"restore", cacheRestoreScript(caches), []string{
+			`if [ -d "/cache/go-0123" ] ; then`,
+			`cp -a "/cache/go-0123/0/." "/cache-paths/0/0"`,
+			`cp -a "/cache/go-0123/1/." "/cache-paths/0/1"`,
+			`cp -a "/cache/npm/0/." "/cache-paths/1/0"`,
+		}},
+		{"save", cacheSaveScript(caches), []string{
+			`if [ ! -d "/cache/go-0123" ] ; then`,
+			`mkdir -p "/cache/.tmp-go-0123-$HOSTNAME"`,
+			`cp -a "/cache-paths/0/1" "/cache/.tmp-go-0123-$HOSTNAME/1"`,
+			`mv "/cache/.tmp-go-0123-$HOSTNAME" "/cache/go-0123"`,
+			`rm -rf "/cache/go-0123/.tmp-go-0123-$HOSTNAME"`,
+			`cp -a "/cache-paths/1/0" "/cache/.tmp-npm-$HOSTNAME/0"`,
+		}},
+	}
+	for _, tt := range tests {
+		if !strings.HasPrefix(tt.script, "set -e\n") {
+			t.Errorf("%s: script doesn't stop on errors", tt.name)
+		}
+		for _, line := range tt.want {
+			if !strings.Contains(tt.script, line) {
+				t.Errorf("%s: script doesn't contain %s:\n%s", tt.name, line, tt.script)
+			}
+		}
+	}
+}
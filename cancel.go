@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// podDeletionTimeout is how long a task that is being run again waits for
+// the pod or Job of its previous run to go. Cancelled pods are deleted
+// straight away, but finished ones are only deleted once the controller is
+// done with them.
+const podDeletionTimeout = 2 * time.Minute
+
+// cancelPods stops the unfinished task pods that match selector and match,
+// and sets their status to error with description.
+//
+// The pods are marked as cancelled before they are deleted so that the
+// controller leaves their status alone.
+func cancelPods(ctx context.Context, selector string, match func(pod *v1.Pod) bool, description string) error {
+	pods, err := kubeClient.CoreV1().Pods(*kubeNamespace).List(metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list pods: %v", err)
+	}
+
+	errs := errorList{}
+	gracePeriod := int64(0)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.DeletionTimestamp != nil || !match(pod) {
+			continue
+		}
+		if state, _ := podState(pod); state != "pending" {
+			continue // the controller is taking care of it
+		}
+
+		// deleting the pod of a job would only make the job replace it
+		if pod.GetObjectMeta().GetLabels()["job-name"] != "" {
+			if err := cancelJob(pod, description); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			if err := setPodStatus(ctx, pod, "error", description, nil); err != nil {
+				errs = append(errs, err)
+			}
+			revokeBrokerToken(pod.ObjectMeta.Annotations["triggr.crewjam.com/broker-secret"])
+			continue
+		}
+
+		pod.ObjectMeta.Annotations["triggr.crewjam.com/cancelled"] = description
+		if _, err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Update(pod); err != nil {
+			errs = append(errs, fmt.Errorf("cannot update pod %s: %v", pod.GetName(), err))
+			continue
+		}
+		if err := setPodStatus(ctx, pod, "error", description, nil); err != nil {
+			errs = append(errs, err)
+		}
+		revokeBrokerToken(pod.ObjectMeta.Annotations["triggr.crewjam.com/broker-secret"])
+		err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Delete(pod.GetName(), &metav1.DeleteOptions{
+			GracePeriodSeconds: &gracePeriod,
+		})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete pod %s: %v", pod.GetName(), err))
+		}
+	}
+	return errs.ReturnValue()
+}
+
+// podSelector returns the label selector for the task pods of the
+// repository being built.
+func (b *Builder) podSelector() string {
+	return fmt.Sprintf("triggr=true,owner=%s,repo=%s", b.Owner, b.Repo.GetName())
+}
+
+// ownsPod returns true if pod runs one of the tasks of the build. If b.Only
+// is set, only the pods of those tasks count. The Jobs that run tasks carry
+// the same annotations, so this works for them too.
+func (b *Builder) ownsPod(pod *v1.Pod) bool {
+	return b.owns(pod.GetObjectMeta())
+}
+
+func (b *Builder) owns(obj metav1.Object) bool {
+	annotations := obj.GetAnnotations()
+	if annotations["triggr.crewjam.com/github-ref"] != b.SHA {
+		return false
+	}
+	if annotations["triggr.crewjam.com/event"] != b.Event {
+		return false
+	}
+	return len(b.Only) == 0 || contains(b.Only, annotations["triggr.crewjam.com/task-name"])
+}
+
+// clearPreviousRun deletes the finished Jobs of the build, which are
+// otherwise kept until -job-ttl, and waits until they and the pods of the
+// build are gone, so that the tasks can be started again under the same
+// names. It is called once the build has been cancelled.
+func (b *Builder) clearPreviousRun(ctx context.Context) error {
+	if runAsJobs() {
+		jobs, err := kubeClient.BatchV1().Jobs(*kubeNamespace).List(metav1.ListOptions{
+			LabelSelector: b.podSelector(),
+		})
+		if err != nil {
+			return fmt.Errorf("cannot list jobs: %v", err)
+		}
+		propagation := metav1.DeletePropagationBackground
+		for i := range jobs.Items {
+			job := &jobs.Items[i]
+			if !b.owns(job.GetObjectMeta()) || !jobFinished(job) || job.DeletionTimestamp != nil {
+				continue
+			}
+			err := kubeClient.BatchV1().Jobs(job.GetNamespace()).Delete(job.GetName(), &metav1.DeleteOptions{
+				PropagationPolicy: &propagation,
+			})
+			if err != nil && !apierrors.IsNotFound(err) {
+				return fmt.Errorf("cannot delete job %s: %v", job.GetName(), err)
+			}
+		}
+	}
+
+	remaining := []string{}
+	err := wait.PollImmediate(time.Second, podDeletionTimeout, func() (bool, error) {
+		remaining = remaining[:0]
+		pods, err := kubeClient.CoreV1().Pods(*kubeNamespace).List(metav1.ListOptions{
+			LabelSelector: b.podSelector(),
+		})
+		if err != nil {
+			return false, fmt.Errorf("cannot list pods: %v", err)
+		}
+		for i := range pods.Items {
+			if b.ownsPod(&pods.Items[i]) {
+				remaining = append(remaining, "pod "+pods.Items[i].GetName())
+			}
+		}
+		if runAsJobs() {
+			jobs, err := kubeClient.BatchV1().Jobs(*kubeNamespace).List(metav1.ListOptions{
+				LabelSelector: b.podSelector(),
+			})
+			if err != nil {
+				return false, fmt.Errorf("cannot list jobs: %v", err)
+			}
+			for i := range jobs.Items {
+				if b.owns(jobs.Items[i].GetObjectMeta()) {
+					remaining = append(remaining, "job "+jobs.Items[i].GetName())
+				}
+			}
+		}
+		return len(remaining) == 0, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("%s still there after %s", strings.Join(remaining, ", "), podDeletionTimeout)
+	}
+	return err
+}
+
+// cancel stops the tasks of the build that are still running or waiting to
+// run, and sets their status to error with description. If b.Only is set,
+// only those tasks are cancelled.
+func (b *Builder) cancel(ctx context.Context, description string) error {
+	err := cancelPods(ctx, b.podSelector(), b.ownsPod, description)
+	if err != nil {
+		return err
+	}
+
+	// nor do the tasks that are still in the build queue
+	queued := buildQueue.Remove(func(other *Builder, task TaskConfig) bool {
+		return other.Repo.GetFullName() == b.Repo.GetFullName() &&
+			other.SHA == b.SHA &&
+			other.Event == b.Event &&
+			(len(b.Only) == 0 || contains(b.Only, task.Name))
+	})
+	for _, item := range queued {
+		if err := item.Builder.setStatus(ctx, item.Task, "error", description); err != nil {
+			return err
+		}
+	}
+
+	// the tasks that are still waiting don't have pods yet
+	if !crdsInstalled {
+		return nil
+	}
+	if err := b.getConfig(ctx); err != nil {
+		return err
+	}
+	statuses, err := b.taskRunStatuses()
+	if err != nil {
+		return err
+	}
+	for _, task := range b.Config.Tasks {
+		if statuses[b.statusContext(task)].Phase == phaseWaiting {
+			if err := b.setStatus(ctx, task, "error", description); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// supersedes returns true if other builds an older revision of the same pull
+// request or branch as b.
+func (b *Builder) supersedes(other *Builder) bool {
+	return other.Repo.GetFullName() == b.Repo.GetFullName() &&
+		other.SHA != b.SHA &&
+		other.Event == b.Event &&
+		other.Ref == b.Ref
+}
+
+// supersedesPod returns true if pod runs a task of a build that b supersedes.
+func (b *Builder) supersedesPod(pod *v1.Pod) bool {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	return annotations["triggr.crewjam.com/github-owner"] == b.Owner &&
+		annotations["triggr.crewjam.com/github-repo"] == b.Repo.GetName() &&
+		annotations["triggr.crewjam.com/github-ref"] != b.SHA &&
+		annotations["triggr.crewjam.com/event"] == b.Event &&
+		annotations["triggr.crewjam.com/git-ref"] == b.Ref
+}
+
+// cancelSuperseded cancels the builds of older revisions of the same pull
+// request, or of the same branch, that are still running.
+func (b *Builder) cancelSuperseded(ctx context.Context) error {
+	if b.Event != "pull-request" && b.Event != "push" {
+		return nil
+	}
+	selector := b.podSelector()
+	if b.PullRequest != nil {
+		selector += ",pr=" + strconv.Itoa(b.PullRequest.GetNumber())
+	}
+	pods, err := kubeClient.CoreV1().Pods(*kubeNamespace).List(metav1.ListOptions{
+		LabelSelector: selector,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list pods: %v", err)
+	}
+
+	errs := errorList{}
+	queued := buildQueue.Remove(func(other *Builder, task TaskConfig) bool {
+		return b.supersedes(other)
+	})
+	for _, item := range queued {
+		if err := item.Builder.setStatus(ctx, item.Task, "error", "superseded by "+b.SHA[:7]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	superseded := map[string]bool{}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		sha := pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/github-ref"]
+		if superseded[sha] || !b.supersedesPod(pod) {
+			continue
+		}
+		superseded[sha] = true
+
+		old, err := builderFromPod(ctx, pod)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Printf("%s: %s is superseded by %s", b.Repo.GetFullName(), sha, b.SHA)
+		if err := old.cancel(ctx, "superseded by "+b.SHA[:7]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs.ReturnValue()
+}
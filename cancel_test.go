@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestSupersedes(t *testing.T) {
+	repo := func(fullName string) *github.Repository {
+		return &github.Repository{FullName: github.String(fullName)}
+	}
+	b := &Builder{Repo: repo("crewjam/triggr"), SHA: "def", Event: "push", Ref: "refs/heads/main"}
+	tests := []struct {
+		name  string
+		other *Builder
+		want  bool
+	}{
+		{"older revision", &Builder{Repo: repo("crewjam/triggr"), SHA: "abc", Event: "push", Ref: "refs/heads/main"}, true},
+		{"same revision", &Builder{Repo: repo("crewjam/triggr"), SHA: "def", Event: "push", Ref: "refs/heads/main"}, false},
+		{"other branch", &Builder{Repo: repo("crewjam/triggr"), SHA: "abc", Event: "push", Ref: "refs/heads/dev"}, false},
+		{"other event", &Builder{Repo: repo("crewjam/triggr"), SHA: "abc", Event: "schedule", Ref: "refs/heads/main"}, false},
+		{"other repository", &Builder{Repo: repo("crewjam/saml"), SHA: "abc", Event: "push", Ref: "refs/heads/main"}, false},
+	}
+	for _, tt := range tests {
+		if got := b.supersedes(tt.other); got != tt.want {
+			t.Errorf("%s: supersedes() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSupersedesPod(t *testing.T) {
+	pod := func(repo, sha, event, ref string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"triggr.crewjam.com/github-owner": "crewjam",
+			"triggr.crewjam.com/github-repo":  repo,
+			"triggr.crewjam.com/github-ref":   sha,
+			"triggr.crewjam.com/event":        event,
+			"triggr.crewjam.com/git-ref":      ref,
+		}}}
+	}
+	b := &Builder{
+		Repo:  &github.Repository{Name: github.String("triggr")},
+		Owner: "crewjam",
+		SHA:   "def",
+		Event: "pull-request",
+		Ref:   "refs/pull/7/merge",
+	}
+	tests := []struct {
+		name string
+		pod  *v1.Pod
+		want bool
+	}{
+		{"older revision", pod("triggr", "abc", "pull-request", "refs/pull/7/merge"), true},
+		{"same revision", pod("triggr", "def", "pull-request", "refs/pull/7/merge"), false},
+		{"other pull request", pod("triggr", "abc", "pull-request", "refs/pull/8/merge"), false},
+		{"push", pod("triggr", "abc", "push", "refs/pull/7/merge"), false},
+		{"other repository", pod("saml", "abc", "pull-request", "refs/pull/7/merge"), false},
+	}
+	for _, tt := range tests {
+		if got := b.supersedesPod(tt.pod); got != tt.want {
+			t.Errorf("%s: supersedesPod() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+// workspaceDir is where the source is checked out in the task's containers.
+const workspaceDir = "/workspace"
+
+// checkoutScript checks out GIT_REF from GIT_CLONE_URL into the current
+// directory.
+const checkoutScript = `set -e
+git init -q .
+git remote add origin "$GIT_CLONE_URL"
+if [ "$CLONE_DEPTH" -gt 0 ] ; then
+    git fetch -q --depth "$CLONE_DEPTH" origin "$GIT_REF"
+else
+    git fetch -q origin "$GIT_REF"
+fi
+git checkout -qf FETCH_HEAD
+if [ "$SUBMODULES" = "true" ] ; then
+    git submodule -q update --init --recursive
+fi
+if [ "$LFS" = "true" ] ; then
+    git lfs install --local
+    git lfs pull
+fi
+git log -1 --format="checked out %H"
+`
+
+// cloneURL returns the URL that task pods clone the repository from, which
+// is the broker's. It refers to the broker token in the TRIGGR_TOKEN
+// environment variable.
+func (b *Builder) cloneURL() string {
+	u := strings.Replace(brokerURL(), "://", "://x-token:$(TRIGGR_TOKEN)@", 1)
+	return fmt.Sprintf("%s/broker/git/%s.git", u, b.Repo.GetFullName())
+}
+
+// addCheckout adds an init container to pod that checks out the source into
+// a volume shared with the exec container, so that the task image doesn't
+// have to do it.
+func (b *Builder) addCheckout(pod *v1.Pod, task TaskConfig) {
+	pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{
+		Name: "workspace",
+		VolumeSource: v1.VolumeSource{
+			EmptyDir: &v1.EmptyDirVolumeSource{},
+		},
+	})
+	workspaceMount := v1.VolumeMount{
+		Name:      "workspace",
+		MountPath: workspaceDir,
+	}
+
+	image := *checkoutImage
+	if image == "" {
+		image = "alpine/git"
+	}
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, v1.Container{
+		Name:       "checkout",
+		Image:      image,
+		Command:    []string{"/bin/sh", "-c", checkoutScript},
+		WorkingDir: workspaceDir,
+		Env: []v1.EnvVar{
+			{
+				Name:  "GIT_REF",
+				Value: b.Ref,
+			},
+			{
+				Name:  "CLONE_DEPTH",
+				Value: strconv.Itoa(task.CloneDepth),
+			},
+			{
+				Name:  "SUBMODULES",
+				Value: strconv.FormatBool(task.Submodules),
+			},
+			{
+				Name:  "LFS",
+				Value: strconv.FormatBool(task.LFS),
+			},
+		},
+		VolumeMounts: []v1.VolumeMount{workspaceMount},
+	})
+
+	exec := &pod.Spec.Containers[0]
+	exec.WorkingDir = workspaceDir
+	exec.VolumeMounts = append(exec.VolumeMounts, workspaceMount)
+	exec.Env = append(exec.Env, v1.EnvVar{
+		Name:  "WORKSPACE",
+		Value: workspaceDir,
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+	"k8s.io/api/core/v1"
+)
+
+// reportChecks returns true if task results are reported as check runs
+// rather than commit statuses.
+func reportChecks() bool {
+	return *githubReporter == "checks"
+}
+
+// checkReport is the state of a task as it is reported in a check run.
+type checkReport struct {
+	Owner       string
+	Repo        string
+	SHA         string
+	Name        string
+	DetailsURL  string
+	State       string // a commit status state: pending, success, failure or error
+	Description string
+	Conclusion  string    // overrides the conclusion implied by State
+	StartedAt   time.Time // zero if not known
+	CompletedAt time.Time
+	Summary     string
+	Output      []byte // the output of the task, once it has finished
+}
+
+// checkRunRequest is the body of a request to create or update a check run.
+// go-github's options for updating a check run leave out started_at, so the
+// requests are made directly.
+type checkRunRequest struct {
+	Name        string                 `json:"name"`
+	HeadSHA     string                 `json:"head_sha,omitempty"`
+	DetailsURL  string                 `json:"details_url,omitempty"`
+	Status      string                 `json:"status"`
+	Conclusion  string                 `json:"conclusion,omitempty"`
+	StartedAt   *github.Timestamp      `json:"started_at,omitempty"`
+	CompletedAt *github.Timestamp      `json:"completed_at,omitempty"`
+	Output      *github.CheckRunOutput `json:"output,omitempty"`
+}
+
+// checkRunsPreview is the media type needed for the checks API.
+const checkRunsPreview = "application/vnd.github.antiope-preview+json"
+
+// maxCheckText is the most output that is put in a check run. Github allows
+// 65535 characters.
+const maxCheckText = 60000
+
+// maxCheckAnnotations is the most annotations github accepts in one request.
+const maxCheckAnnotations = 50
+
+// setCheckRun reports r in the check run for the task. A check run that
+// hasn't completed is updated, otherwise a new one is created, so that
+// building a revision again gets a fresh check run.
+func setCheckRun(ctx context.Context, r checkReport) error {
+	existing, err := findCheckRun(ctx, r.Owner, r.Repo, r.SHA, r.Name)
+	if err != nil {
+		return err
+	}
+
+	req := checkRunRequest{
+		Name:       r.Name,
+		DetailsURL: r.DetailsURL,
+		Status:     "in_progress",
+		Output: &github.CheckRunOutput{
+			Title:   github.String(r.Description),
+			Summary: github.String(r.Summary),
+		},
+	}
+	if r.Summary == "" {
+		req.Output.Summary = github.String(r.Description)
+	}
+	if !r.StartedAt.IsZero() {
+		req.StartedAt = &github.Timestamp{Time: r.StartedAt}
+	}
+	switch {
+	case r.State != "pending":
+		req.Status = "completed"
+		req.Conclusion = r.Conclusion
+		if req.Conclusion == "" {
+			req.Conclusion = checkConclusion(r.State, r.Description)
+		}
+		completedAt := r.CompletedAt
+		if completedAt.IsZero() {
+			completedAt = time.Now()
+		}
+		req.CompletedAt = &github.Timestamp{Time: completedAt}
+	case strings.HasPrefix(r.Description, waitingPrefix), strings.HasPrefix(r.Description, "queued"),
+		r.Description == awaitingApproval:
+		req.Status = "queued"
+	}
+	if len(r.Output) > 0 {
+		req.Output.Text = github.String(checkText(r.Output))
+		level := "warning"
+		if r.State != "success" {
+			level = "failure"
+		}
+		req.Output.Annotations = checkAnnotations(r.Output, level)
+	}
+
+	method, url := "POST", fmt.Sprintf("repos/%s/%s/check-runs", r.Owner, r.Repo)
+	if existing != nil {
+		method, url = "PATCH", fmt.Sprintf("%s/%d", url, existing.GetID())
+	} else {
+		req.HeadSHA = r.SHA
+	}
+	client, err := repoClient(ctx, r.Owner, r.Repo)
+	if err != nil {
+		return err
+	}
+	httpReq, err := client.NewRequest(method, url, req)
+	if err != nil {
+		return fmt.Errorf("cannot create check run request: %v", err)
+	}
+	httpReq.Header.Set("Accept", checkRunsPreview)
+	if _, err := client.Do(ctx, httpReq, nil); err != nil {
+		return fmt.Errorf("cannot set check run: %v", err)
+	}
+	return nil
+}
+
+// findCheckRun returns the check run called name on sha that hasn't
+// completed yet, or nil if there isn't one.
+func findCheckRun(ctx context.Context, owner, repo, sha, name string) (*github.CheckRun, error) {
+	runs, err := listCheckRuns(ctx, owner, repo, sha, name)
+	if err != nil {
+		return nil, err
+	}
+	for _, run := range runs {
+		if run.GetStatus() != "completed" {
+			return run, nil
+		}
+	}
+	return nil, nil
+}
+
+// listCheckRuns returns the check runs on sha, newest first. If name is not
+// empty, only the check runs with that name are returned.
+func listCheckRuns(ctx context.Context, owner, repo, sha, name string) ([]*github.CheckRun, error) {
+	client, err := repoClient(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	rv := []*github.CheckRun{}
+	opts := &github.ListCheckRunsOptions{
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	if name != "" {
+		opts.CheckName = github.String(name)
+	}
+	for {
+		results, resp, err := client.Checks.ListCheckRunsForRef(ctx, owner, repo, sha, opts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot list check runs: %v", err)
+		}
+		rv = append(rv, results.CheckRuns...)
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	// the ids increase as check runs are created
+	sort.Slice(rv, func(i, j int) bool { return rv[i].GetID() > rv[j].GetID() })
+	return rv, nil
+}
+
+// checkRunState returns the state of a check run in the terms of commit
+// statuses, which is what the rest of triggr deals in.
+func checkRunState(run *github.CheckRun) string {
+	if run.GetStatus() != "completed" {
+		return "pending"
+	}
+	switch run.GetConclusion() {
+	case "success", "neutral", "skipped":
+		return "success"
+	case "failure":
+		return "failure"
+	default:
+		return "error"
+	}
+}
+
+// checkConclusion returns the conclusion of a check run for a task that
+// ended in state.
+func checkConclusion(state, description string) string {
+	switch {
+	case state == "success" && strings.HasPrefix(description, "skipped"):
+		return "skipped"
+	case state == "success":
+		return "success"
+	case strings.HasPrefix(description, "timed out"):
+		return "timed_out"
+	default:
+		return "failure"
+	}
+}
+
+// checkText returns the tail of a task's output, formatted for a check run.
+func checkText(output []byte) string {
+	if len(output) > maxCheckText {
+		output = output[len(output)-maxCheckText:]
+		if i := bytes.IndexByte(output, '\n'); i >= 0 {
+			output = output[i+1:]
+		}
+	}
+	return "```\n" + strings.Replace(string(output), "```", "` ` `", -1) + "\n```"
+}
+
+// annotationRegexp matches the file:line: message form that compilers and
+// linters use to point at a line of code, optionally with a column.
+var annotationRegexp = regexp.MustCompile(`^(?:\./|` + regexp.QuoteMeta(workspaceDir) + `/)?([\w.][\w./-]*\.\w+):(\d+)(?::\d+)?: (.+)$`)
+
+// checkAnnotations returns an annotation for each line of output that points
+// at a line of code.
+func checkAnnotations(output []byte, level string) []*github.CheckRunAnnotation {
+	rv := []*github.CheckRunAnnotation{}
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() && len(rv) < maxCheckAnnotations {
+		line := strings.TrimSpace(scanner.Text())
+		m := annotationRegexp.FindStringSubmatch(line)
+		if m == nil || seen[line] {
+			continue
+		}
+		seen[line] = true
+		lineNumber, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		rv = append(rv, &github.CheckRunAnnotation{
+			Path:            github.String(m[1]),
+			StartLine:       github.Int(lineNumber),
+			EndLine:         github.Int(lineNumber),
+			AnnotationLevel: github.String(level),
+			Message:         github.String(m[3]),
+		})
+	}
+	return rv
+}
+
+// podCheckReport returns the check run report for the task run by pod.
+func podCheckReport(pod *v1.Pod, state, description string, output []byte) checkReport {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	r := checkReport{
+		Owner:       annotations["triggr.crewjam.com/github-owner"],
+		Repo:        annotations["triggr.crewjam.com/github-repo"],
+		SHA:         annotations["triggr.crewjam.com/github-ref"],
+		Name:        annotations["triggr.crewjam.com/github-status-context"],
+		DetailsURL:  annotations["triggr.crewjam.com/github-target-url"],
+		State:       state,
+		Description: description,
+		Output:      output,
+	}
+	r.StartedAt, r.CompletedAt = podTimes(pod)
+	switch {
+	case state == "pending":
+	case annotations["triggr.crewjam.com/cancelled"] != "":
+		r.Conclusion = "cancelled"
+	case pod.Status.Reason == "DeadlineExceeded":
+		r.Conclusion = "timed_out"
+	}
+
+	summary := bytes.NewBuffer(nil)
+	fmt.Fprintf(summary, "**%s**\n\n", description)
+	fmt.Fprintf(summary, "Task `%s` ran in pod `%s`", annotations["triggr.crewjam.com/task-name"], pod.GetName())
+	if attempt := podAttempt(pod); attempt > 1 {
+		fmt.Fprintf(summary, " (attempt %d of %s)", attempt, attemptCount(pod))
+	}
+	fmt.Fprintf(summary, ".\n")
+	if steps, containers := podSteps(pod); len(steps) > 0 {
+		fmt.Fprintf(summary, "\n| Step | Result |\n| --- | --- |\n")
+		for i, step := range steps {
+			fmt.Fprintf(summary, "| %s | %s |\n", step, containerResult(pod, containers[i]))
+		}
+	}
+	r.Summary = summary.String()
+	return r
+}
+
+// podTimes returns when pod started and when its exec container finished,
+// either of which is zero if it hasn't happened yet.
+func podTimes(pod *v1.Pod) (startedAt, completedAt time.Time) {
+	if pod.Status.StartTime != nil {
+		startedAt = pod.Status.StartTime.Time
+	}
+	if containerStatus := execStatus(pod); containerStatus != nil {
+		if t := containerStatus.State.Terminated; t != nil {
+			completedAt = t.FinishedAt.Time
+		}
+	}
+	return startedAt, completedAt
+}
+
+// containerResult describes how the container called name in pod ended.
+func containerResult(pod *v1.Pod, name string) string {
+	for _, containerStatus := range allContainerStatuses(pod) {
+		if containerStatus.Name != name {
+			continue
+		}
+		switch {
+		case containerStatus.State.Terminated == nil:
+			return "did not finish"
+		case containerStatus.State.Terminated.ExitCode == 0:
+			return "succeeded"
+		default:
+			return fmt.Sprintf("failed (exit code %d)", containerStatus.State.Terminated.ExitCode)
+		}
+	}
+	return "did not run"
+}
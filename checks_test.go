@@ -0,0 +1,82 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+)
+
+func TestCheckConclusion(t *testing.T) {
+	tests := []struct {
+		state       string
+		description string
+		want        string
+	}{
+		{"success", "success", "success"},
+		{"success", "skipped: no relevant changes", "skipped"},
+		{"failure", "exit code 1", "failure"},
+		{"error", "timed out after 30m0s", "timed_out"},
+		{"error", "task pod was deleted before completion", "failure"},
+	}
+	for _, tt := range tests {
+		if got := checkConclusion(tt.state, tt.description); got != tt.want {
+			t.Errorf("checkConclusion(%q, %q) = %q, want %q", tt.state, tt.description, got, tt.want)
+		}
+	}
+}
+
+func TestCheckRunState(t *testing.T) {
+	tests := []struct {
+		status     string
+		conclusion string
+		want       string
+	}{
+		{"queued", "", "pending"},
+		{"in_progress", "", "pending"},
+		{"completed", "success", "success"},
+		{"completed", "neutral", "success"},
+		{"completed", "skipped", "success"},
+		{"completed", "failure", "failure"},
+		{"completed", "timed_out", "error"},
+		{"completed", "cancelled", "error"},
+	}
+	for _, tt := range tests {
+		run := &github.CheckRun{Status: github.String(tt.status), Conclusion: github.String(tt.conclusion)}
+		if got := checkRunState(run); got != tt.want {
+			t.Errorf("checkRunState(%s, %s) = %q, want %q", tt.status, tt.conclusion, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAnnotations(t *testing.T) {
+	annotation := func(path string, line int, message string) *github.CheckRunAnnotation {
+		return &github.CheckRunAnnotation{
+			Path:            github.String(path),
+			StartLine:       github.Int(line),
+			EndLine:         github.Int(line),
+			AnnotationLevel: github.String("failure"),
+			Message:         github.String(message),
+		}
+	}
+	tests := []struct {
+		output string
+		want   []*github.CheckRunAnnotation
+	}{
+		{"ok  \tgithub.com/crewjam/triggr\t0.01s\n", []*github.CheckRunAnnotation{}},
+		{"main.go:12: undefined: foo\n", []*github.CheckRunAnnotation{
+			annotation("main.go", 12, "undefined: foo")}},
+		{"./cmd/app/main.go:3:7: missing return\n", []*github.CheckRunAnnotation{
+			annotation("cmd/app/main.go", 3, "missing return")}},
+		{workspaceDir + "/queue.go:40: unused variable\n", []*github.CheckRunAnnotation{
+			annotation("queue.go", 40, "unused variable")}},
+		{"  a.go:1: x\n  a.go:1: x\nb.go:2: y\n", []*github.CheckRunAnnotation{
+			annotation("a.go", 1, "x"), annotation("b.go", 2, "y")}},
+		{"http://example.com:80: not a file\n", []*github.CheckRunAnnotation{}},
+	}
+	for _, tt := range tests {
+		if got := checkAnnotations([]byte(tt.output), "failure"); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("checkAnnotations(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
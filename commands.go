@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/go-github/v39/github"
+)
+
+// parseCommands returns the triggr commands in a comment, one per line, e.g.
+// `/triggr retest lint` is returned as ["retest", "lint"].
+func parseCommands(body string) [][]string {
+	commands := [][]string{}
+	for _, line := range strings.Split(body, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "/triggr" {
+			continue
+		}
+		commands = append(commands, fields[1:])
+	}
+	return commands
+}
+
+func validCommand(command []string) bool {
+	switch command[0] {
+	case "retest":
+		return true
+	case "cancel", "ok-to-test":
+		return len(command) == 1
+	case "run":
+		return len(command) > 1
+	}
+	return false
+}
+
+// handleIssueComment runs the triggr commands in a comment on a pull
+// request. Only users who can write to the repository may run them. The
+// comment gets a reaction to show whether the commands were accepted.
+func handleIssueComment(ctx context.Context, event *github.IssueCommentEvent) error {
+	commands := parseCommands(event.Comment.GetBody())
+	if len(commands) == 0 {
+		return nil
+	}
+	owner := event.Repo.Owner.GetLogin()
+	repo := event.Repo.GetName()
+	user := event.Comment.User.GetLogin()
+	client, err := repoClient(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+	react := func(content string) error {
+		_, _, err := client.Reactions.CreateIssueCommentReaction(ctx,
+			owner, repo, event.Comment.GetID(), content)
+		if err != nil {
+			return fmt.Errorf("cannot react to comment: %v", err)
+		}
+		return nil
+	}
+
+	for _, command := range commands {
+		if !validCommand(command) {
+			log.Printf("%s/%s#%d: invalid command from %s: %s", owner, repo,
+				event.Issue.GetNumber(), user, strings.Join(command, " "))
+			return react("confused")
+		}
+	}
+
+	permission, _, err := client.Repositories.GetPermissionLevel(ctx, owner, repo, user)
+	if err != nil {
+		return fmt.Errorf("cannot fetch permission level: %v", err)
+	}
+	if p := permission.GetPermission(); p != "admin" && p != "write" {
+		log.Printf("%s/%s#%d: %s may not run commands", owner, repo,
+			event.Issue.GetNumber(), user)
+		return react("-1")
+	}
+
+	// the event doesn't say what the head of the pull request is, and it
+	// may have moved anyway
+	pr, _, err := client.PullRequests.Get(ctx, owner, repo, event.Issue.GetNumber())
+	if err != nil {
+		return fmt.Errorf("cannot fetch pull request: %v", err)
+	}
+
+	if err := react("+1"); err != nil {
+		return err
+	}
+	// running tasks again waits for their previous pods to go, which can
+	// take longer than github waits for the webhook to respond
+	go func() {
+		for _, command := range commands {
+			log.Printf("%s/%s#%d: %s ran %s", owner, repo, pr.GetNumber(), user,
+				strings.Join(command, " "))
+			if err := runCommand(context.Background(), pr, user, command); err != nil {
+				log.Printf("%s/%s#%d: %s: %v", owner, repo, pr.GetNumber(),
+					strings.Join(command, " "), err)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func runCommand(ctx context.Context, pr *github.PullRequest, user string, command []string) error {
+	b := newPullRequestBuilder(pr)
+	switch command[0] {
+	case "cancel":
+		return b.cancel(ctx, "cancelled by @"+user)
+	case "ok-to-test":
+		// labelling the pull request starts the build, and keeps it
+		// approved when more commits are pushed.
+		return b.approve(ctx)
+	}
+	b.Only = command[1:]
+	b.Manual = command[0] == "run"
+
+	// stop whatever is still running of the tasks we are about to start
+	if err := b.cancel(ctx, "restarted by @"+user); err != nil {
+		return err
+	}
+	if err := b.clearPreviousRun(ctx); err != nil {
+		return err
+	}
+	return b.Build(ctx)
+}
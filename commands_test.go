@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCommands(t *testing.T) {
+	tests := []struct {
+		body string
+		want [][]string
+	}{
+		{"", [][]string{}},
+		{"looks good to me", [][]string{}},
+		{"/triggr retest", [][]string{{"retest"}}},
+		{"/triggr retest lint test", [][]string{{"retest", "lint", "test"}}},
+		{"  /triggr   run  deploy  ", [][]string{{"run", "deploy"}}},
+		{"thanks!\n/triggr ok-to-test\n/triggr retest", [][]string{{"ok-to-test"}, {"retest"}}},
+		{"/triggr cancel\r\n/triggr retest\r\n", [][]string{{"cancel"}, {"retest"}}},
+		{"/triggr", [][]string{}},
+		{"please /triggr retest", [][]string{}},
+		{"/triggrs retest", [][]string{}},
+		{"> /triggr retest", [][]string{}},
+	}
+	for _, tt := range tests {
+		if got := parseCommands(tt.body); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCommands(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestValidCommand(t *testing.T) {
+	tests := []struct {
+		command []string
+		want    bool
+	}{
+		{[]string{"retest"}, true},
+		{[]string{"retest", "lint", "test"}, true},
+		{[]string{"cancel"}, true},
+		{[]string{"cancel", "lint"}, false},
+		{[]string{"ok-to-test"}, true},
+		{[]string{"ok-to-test", "please"}, false},
+		{[]string{"run", "deploy"}, true},
+		{[]string{"run"}, false},
+		{[]string{"deploy"}, false},
+	}
+	for _, tt := range tests {
+		if got := validCommand(tt.command); got != tt.want {
+			t.Errorf("validCommand(%q) = %v, want %v", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestBuilderOwnsPod(t *testing.T) {
+	pod := func(sha, event, task string) *v1.Pod {
+		return &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"triggr.crewjam.com/github-ref": sha,
+			"triggr.crewjam.com/event":      event,
+			"triggr.crewjam.com/task-name":  task,
+		}}}
+	}
+	tests := []struct {
+		name string
+		only []string
+		pod  *v1.Pod
+		want bool
+	}{
+		{"whole build", nil, pod("abc", "pull-request", "lint"), true},
+		{"other revision", nil, pod("def", "pull-request", "lint"), false},
+		{"other event", nil, pod("abc", "push", "lint"), false},
+		{"retested task", []string{"test"}, pod("abc", "pull-request", "test"), true},
+		{"task not retested", []string{"test"}, pod("abc", "pull-request", "lint"), false},
+	}
+	for _, tt := range tests {
+		b := &Builder{SHA: "abc", Event: "pull-request", Only: tt.only}
+		if got := b.ownsPod(tt.pod); got != tt.want {
+			t.Errorf("%s: ownsPod() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+)
+
+// The Build and TaskRun custom resources keep the history of builds in the
+// cluster, where it outlives the task pods. A Build records what triggered it
+// and the configuration it ran with, and owns a TaskRun for each of its
+// tasks, which in turn owns the pods that run the task. The resources are
+// defined in crds.yaml.
+
+// crdGroupVersion is the API group and version of the custom resources.
+var crdGroupVersion = schema.GroupVersion{Group: "triggr.crewjam.com", Version: "v1alpha1"}
+
+// triggrClient is the client for the custom resources.
+var triggrClient *rest.RESTClient
+
+// crdsInstalled is true if the custom resources are installed. They are
+// optional: without them builds aren't recorded, aren't picked up again when
+// the server restarts, and can't have tasks that need other tasks.
+var crdsInstalled bool
+
+// The phases of a TaskRun. A Build is Running until all of its TaskRuns have
+// finished, and then Succeeded or Failed.
+const (
+	phasePending          = "Pending"
+	phaseAwaitingApproval = "AwaitingApproval"
+	phaseWaiting          = "Waiting"
+	phaseQueued           = "Queued"
+	phaseRunning          = "Running"
+	phaseSucceeded        = "Succeeded"
+	phaseSkipped          = "Skipped"
+	phaseFailed           = "Failed"
+	phaseError            = "Error"
+)
+
+// Build records one build of a revision.
+type Build struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BuildSpec   `json:"spec"`
+	Status BuildStatus `json:"status,omitempty"`
+}
+
+// BuildSpec is what triggered a build and the configuration it runs with,
+// with the matrix already expanded.
+type BuildSpec struct {
+	Owner       string   `json:"owner"`
+	Repo        string   `json:"repo"`
+	Event       string   `json:"event"`
+	SHA         string   `json:"sha"`
+	Ref         string   `json:"ref,omitempty"`
+	PullRequest int      `json:"pullRequest,omitempty"`
+	Only        []string `json:"only,omitempty"`
+	Manual      bool     `json:"manual,omitempty"`
+	Trusted     bool     `json:"trusted"`
+	Gist        string   `json:"gist,omitempty"`
+	TargetURL   string   `json:"targetURL,omitempty"`
+	Config      Config   `json:"config"`
+}
+
+type BuildStatus struct {
+	Phase          string       `json:"phase,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+type BuildList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Build `json:"items"`
+}
+
+// TaskRun records one task of a build.
+type TaskRun struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TaskRunSpec   `json:"spec"`
+	Status TaskRunStatus `json:"status,omitempty"`
+}
+
+type TaskRunSpec struct {
+	Build         string `json:"build"`
+	Task          string `json:"task"` // the task's ID
+	StatusContext string `json:"statusContext"`
+}
+
+// TaskRunStatus is the state of a task. State and Description are the
+// task's github status, from which Phase is derived, except that the phase of
+// a task waiting for its needs is set directly. SkippedFor is the need that
+// did not succeed, if the task was skipped because of one.
+type TaskRunStatus struct {
+	Phase          string       `json:"phase,omitempty"`
+	SkippedFor     string       `json:"skippedFor,omitempty"`
+	State          string       `json:"state,omitempty"`
+	Description    string       `json:"description,omitempty"`
+	Pod            string       `json:"pod,omitempty"`     // the most recent pod to run the task
+	Created        bool         `json:"created,omitempty"` // whether the pod or Job of the current attempt exists
+	LogURL         string       `json:"logURL,omitempty"`
+	StartTime      *metav1.Time `json:"startTime,omitempty"`
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+}
+
+type TaskRunList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []TaskRun `json:"items"`
+}
+
+// There are no generated deep copy functions for the custom resources. All
+// of their fields survive a round trip through JSON, so that is how they are
+// copied.
+func deepCopyJSON(in, out interface{}) {
+	buf, err := json.Marshal(in)
+	if err != nil {
+		panic(err)
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		panic(err)
+	}
+}
+
+func (in *Build) DeepCopyObject() runtime.Object {
+	out := &Build{}
+	deepCopyJSON(in, out)
+	return out
+}
+
+func (in *BuildList) DeepCopyObject() runtime.Object {
+	out := &BuildList{}
+	deepCopyJSON(in, out)
+	return out
+}
+
+func (in *TaskRun) DeepCopyObject() runtime.Object {
+	out := &TaskRun{}
+	deepCopyJSON(in, out)
+	return out
+}
+
+func (in *TaskRunList) DeepCopyObject() runtime.Object {
+	out := &TaskRunList{}
+	deepCopyJSON(in, out)
+	return out
+}
+
+// newTriggrClient returns a client for the custom resources.
+func newTriggrClient(kubeConfig *rest.Config) (*rest.RESTClient, error) {
+	scheme := runtime.NewScheme()
+	scheme.AddKnownTypes(crdGroupVersion, &Build{}, &BuildList{}, &TaskRun{}, &TaskRunList{})
+	metav1.AddToGroupVersion(scheme, crdGroupVersion)
+
+	config := *kubeConfig
+	config.GroupVersion = &crdGroupVersion
+	config.APIPath = "/apis"
+	config.ContentType = runtime.ContentTypeJSON
+	config.NegotiatedSerializer = serializer.WithoutConversionCodecFactory{
+		CodecFactory: serializer.NewCodecFactory(scheme),
+	}
+	return rest.RESTClientFor(&config)
+}
+
+// crdOwnerReference returns a reference to the custom resource of kind
+// called name, which makes it the controlling owner of the referring object.
+func crdOwnerReference(kind, name string, uid types.UID) metav1.OwnerReference {
+	controller := true
+	return metav1.OwnerReference{
+		APIVersion: crdGroupVersion.String(),
+		Kind:       kind,
+		Name:       name,
+		UID:        uid,
+		Controller: &controller,
+	}
+}
+
+func getBuild(name string) (*Build, error) {
+	build := &Build{}
+	err := triggrClient.Get().Namespace(*kubeNamespace).Resource("builds").Name(name).Do().Into(build)
+	return build, err
+}
+
+func postBuild(build *Build) (*Build, error) {
+	build.TypeMeta = metav1.TypeMeta{APIVersion: crdGroupVersion.String(), Kind: "Build"}
+	rv := &Build{}
+	err := triggrClient.Post().Namespace(*kubeNamespace).Resource("builds").Body(build).Do().Into(rv)
+	return rv, err
+}
+
+func putBuild(build *Build) (*Build, error) {
+	rv := &Build{}
+	err := triggrClient.Put().Namespace(*kubeNamespace).Resource("builds").Name(build.GetName()).
+		Body(build).Do().Into(rv)
+	return rv, err
+}
+
+func listBuilds(selector string) (*BuildList, error) {
+	list := &BuildList{}
+	err := triggrClient.Get().Namespace(*kubeNamespace).Resource("builds").
+		Param("labelSelector", selector).Do().Into(list)
+	return list, err
+}
+
+func deleteBuild(name string) error {
+	propagation := metav1.DeletePropagationBackground
+	return triggrClient.Delete().Namespace(*kubeNamespace).Resource("builds").Name(name).
+		Body(&metav1.DeleteOptions{PropagationPolicy: &propagation}).Do().Error()
+}
+
+func getTaskRun(name string) (*TaskRun, error) {
+	taskRun := &TaskRun{}
+	err := triggrClient.Get().Namespace(*kubeNamespace).Resource("taskruns").Name(name).Do().Into(taskRun)
+	return taskRun, err
+}
+
+func postTaskRun(taskRun *TaskRun) (*TaskRun, error) {
+	taskRun.TypeMeta = metav1.TypeMeta{APIVersion: crdGroupVersion.String(), Kind: "TaskRun"}
+	rv := &TaskRun{}
+	err := triggrClient.Post().Namespace(*kubeNamespace).Resource("taskruns").Body(taskRun).Do().Into(rv)
+	return rv, err
+}
+
+func putTaskRun(taskRun *TaskRun) (*TaskRun, error) {
+	rv := &TaskRun{}
+	err := triggrClient.Put().Namespace(*kubeNamespace).Resource("taskruns").Name(taskRun.GetName()).
+		Body(taskRun).Do().Into(rv)
+	return rv, err
+}
+
+func listTaskRuns(selector string) (*TaskRunList, error) {
+	list := &TaskRunList{}
+	err := triggrClient.Get().Namespace(*kubeNamespace).Resource("taskruns").
+		Param("labelSelector", selector).Do().Into(list)
+	return list, err
+}
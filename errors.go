@@ -0,0 +1,38 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// errorList collects the errors of steps that are independent of each other,
+// so that one of them failing doesn't stop the rest.
+type errorList []error
+
+func (e errorList) Error() string {
+	messages := []string{}
+	for _, err := range e {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "; ")
+}
+
+// ReturnValue returns nil if there were no errors, or else e.
+func (e errorList) ReturnValue() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// errorHandler is an http.Handler that responds with an internal server
+// error when the function returns an error.
+type errorHandler func(w http.ResponseWriter, r *http.Request) error
+
+func (f errorHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f(w, r); err != nil {
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
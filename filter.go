@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/v39/github"
+)
+
+// getChangedFiles fetches the files changed by the pull request being built,
+// if any of the tasks care about them.
+func (b *Builder) getChangedFiles(ctx context.Context) error {
+	if b.ChangedFiles != nil || b.PullRequest == nil {
+		return nil
+	}
+	needed := false
+	for _, task := range b.Config.Tasks {
+		if len(task.Paths) > 0 || len(task.PathsIgnore) > 0 {
+			needed = true
+		}
+	}
+	if !needed {
+		return nil
+	}
+
+	client, err := b.client(ctx)
+	if err != nil {
+		return err
+	}
+	files := []string{}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		page, resp, err := client.PullRequests.ListFiles(ctx,
+			b.Owner,
+			b.Repo.GetName(),
+			b.PullRequest.GetNumber(),
+			opts)
+		if err != nil {
+			return fmt.Errorf("cannot list pull request files: %v", err)
+		}
+		for _, file := range page {
+			files = append(files, file.GetFilename())
+			if file.GetPreviousFilename() != "" {
+				files = append(files, file.GetPreviousFilename())
+			}
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	b.ChangedFiles = files
+	return nil
+}
+
+// branch returns the name of the branch being built. For pull requests this
+// is the branch the pull request would be merged into. For tags it is empty.
+func (b *Builder) branch() string {
+	if b.PullRequest != nil {
+		return b.PullRequest.GetBase().GetRef()
+	}
+	if !strings.HasPrefix(b.Ref, "refs/heads/") {
+		return ""
+	}
+	return strings.TrimPrefix(b.Ref, "refs/heads/")
+}
+
+// pushBranches returns the patterns for the branches whose pushes are built.
+func (b *Builder) pushBranches() []string {
+	if len(b.Config.PushBranches) > 0 {
+		return b.Config.PushBranches
+	}
+	if *pushBranches == "" {
+		return []string{"master"}
+	}
+	return strings.Split(*pushBranches, ",")
+}
+
+// runsOn returns true if the task should run for event.
+func (t TaskConfig) runsOn(event string) bool {
+	if event == "schedule" && t.Schedule != "" {
+		return true
+	}
+	if len(t.On) == 0 {
+		return event == "push" || event == "pull-request"
+	}
+	for _, on := range t.On {
+		if on == event {
+			return true
+		}
+	}
+	return false
+}
+
+// skipReason returns why task should not run for this build, or an empty
+// string if it should.
+func (b *Builder) skipReason(task TaskConfig) string {
+	if b.Manual {
+		return ""
+	}
+	if len(task.Branches) > 0 && b.branch() != "" && !matchAny(task.Branches, b.branch()) {
+		return "branch " + b.branch() + " not selected"
+	}
+
+	if b.ChangedFiles == nil || (len(task.Paths) == 0 && len(task.PathsIgnore) == 0) {
+		return ""
+	}
+	for _, name := range b.ChangedFiles {
+		if len(task.Paths) > 0 && !matchAny(task.Paths, name) {
+			continue
+		}
+		if matchAny(task.PathsIgnore, name) {
+			continue
+		}
+		return ""
+	}
+	return "no relevant changes"
+}
+
+// matchAny returns true if name matches any of the glob patterns. In a
+// pattern `*` matches anything but a slash, `**` matches anything at all and
+// `?` matches any single character but a slash.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if globRegexp(pattern).MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// globRegexps holds the compiled glob patterns, keyed by pattern, since the
+// same few patterns are matched against every changed file of every build.
+var globRegexps = struct {
+	sync.Mutex
+	m map[string]*regexp.Regexp
+}{m: map[string]*regexp.Regexp{}}
+
+// globRegexp returns the regular expression for a glob pattern, as described
+// for matchAny.
+func globRegexp(pattern string) *regexp.Regexp {
+	globRegexps.Lock()
+	defer globRegexps.Unlock()
+	if re, ok := globRegexps.m[pattern]; ok {
+		return re
+	}
+	re := compileGlob(pattern)
+	globRegexps.m[pattern] = re
+	return re
+}
+
+func compileGlob(pattern string) *regexp.Regexp {
+	expr := bytes.NewBufferString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			// `**/` also matches no directories at all
+			if i+2 < len(pattern) && pattern[i+2] == '/' {
+				expr.WriteString("(.*/)?")
+				i += 2
+			} else {
+				expr.WriteString(".*")
+				i++
+			}
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.MustCompile(expr.String())
+}
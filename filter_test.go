@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+)
+
+func TestMatchAny(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		name     string
+		want     bool
+	}{
+		{[]string{"*.go"}, "main.go", true},
+		{[]string{"*.go"}, "cmd/main.go", false},
+		{[]string{"*.go"}, "main.gox", false},
+		{[]string{"cmd/*/main.go"}, "cmd/triggr/main.go", true},
+		{[]string{"cmd/*/main.go"}, "cmd/a/b/main.go", false},
+		{[]string{"?.txt"}, "a.txt", true},
+		{[]string{"?.txt"}, "ab.txt", false},
+		{[]string{"a?b"}, "a/b", false},
+		{[]string{"**"}, "a/b/c", true},
+		{[]string{"**/*.go"}, "main.go", true},
+		{[]string{"**/*.go"}, "a/b/main.go", true},
+		{[]string{"docs/**"}, "docs/a/b.md", true},
+		{[]string{"docs/**"}, "docsx/a.md", false},
+		{[]string{"a/**/b"}, "a/b", true},
+		{[]string{"a/**/b"}, "a/x/y/b", true},
+		{[]string{"a.b"}, "axb", false},
+		{[]string{"release/*"}, "release/1.0", true},
+		{[]string{"master", "release/*"}, "master", true},
+		{[]string{"master", "release/*"}, "feature", false},
+		{nil, "master", false},
+	}
+	for _, tt := range tests {
+		if got := matchAny(tt.patterns, tt.name); got != tt.want {
+			t.Errorf("matchAny(%q, %q) = %v, want %v", tt.patterns, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGlobRegexpIsCached(t *testing.T) {
+	if globRegexp("src/**/*.go") != globRegexp("src/**/*.go") {
+		t.Errorf("globRegexp compiled the same pattern twice")
+	}
+}
+
+func TestSkipReason(t *testing.T) {
+	tests := []struct {
+		name    string
+		builder Builder
+		task    TaskConfig
+		want    string
+	}{
+		{"no filters", Builder{Ref: "refs/heads/feature"}, TaskConfig{}, ""},
+		{"branch matches",
+			Builder{Ref: "refs/heads/release/1.0"},
+			TaskConfig{Branches: []string{"master", "release/*"}}, ""},
+		{"branch does not match",
+			Builder{Ref: "refs/heads/feature"},
+			TaskConfig{Branches: []string{"master"}}, "branch feature not selected"},
+		{"pull request base branch",
+			Builder{Ref: "refs/heads/feature", PullRequest: &github.PullRequest{
+				Base: &github.PullRequestBranch{Ref: github.String("master")}}},
+			TaskConfig{Branches: []string{"master"}}, ""},
+		{"tags ignore branches",
+			Builder{Ref: "refs/tags/v1.0"},
+			TaskConfig{Branches: []string{"master"}}, ""},
+		{"changed files unknown",
+			Builder{Ref: "refs/heads/master"},
+			TaskConfig{Paths: []string{"docs/**"}}, ""},
+		{"path matches",
+			Builder{Ref: "refs/heads/master", ChangedFiles: []string{"README.md", "docs/index.md"}},
+			TaskConfig{Paths: []string{"docs/**"}}, ""},
+		{"path does not match",
+			Builder{Ref: "refs/heads/master", ChangedFiles: []string{"main.go"}},
+			TaskConfig{Paths: []string{"docs/**"}}, "no relevant changes"},
+		{"all paths ignored",
+			Builder{Ref: "refs/heads/master", ChangedFiles: []string{"README.md", "docs/index.md"}},
+			TaskConfig{PathsIgnore: []string{"*.md", "docs/**"}}, "no relevant changes"},
+		{"some paths not ignored",
+			Builder{Ref: "refs/heads/master", ChangedFiles: []string{"README.md", "main.go"}},
+			TaskConfig{PathsIgnore: []string{"*.md"}}, ""},
+		{"matched path ignored",
+			Builder{Ref: "refs/heads/master", ChangedFiles: []string{"docs/index.md"}},
+			TaskConfig{Paths: []string{"docs/**"}, PathsIgnore: []string{"*.md", "**/*.md"}}, "no relevant changes"},
+		{"manual",
+			Builder{Ref: "refs/heads/feature", ChangedFiles: []string{"main.go"}, Manual: true},
+			TaskConfig{Branches: []string{"master"}, Paths: []string{"docs/**"}}, ""},
+	}
+	for _, tt := range tests {
+		if got := tt.builder.skipReason(tt.task); got != tt.want {
+			t.Errorf("%s: skipReason() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBranch(t *testing.T) {
+	tests := []struct {
+		name string
+		b    Builder
+		want string
+	}{
+		{"push", Builder{Ref: "refs/heads/release/1.0"}, "release/1.0"},
+		{"tag", Builder{Ref: "refs/tags/v1.0.0"}, ""},
+		{"pull request", Builder{Ref: "refs/pull/7/merge", PullRequest: &github.PullRequest{
+			Base: &github.PullRequestBranch{Ref: github.String("main")},
+		}}, "main"},
+	}
+	for _, tt := range tests {
+		if got := tt.b.branch(); got != tt.want {
+			t.Errorf("%s: branch() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPushBranches(t *testing.T) {
+	tests := []struct {
+		flag   string
+		config []string
+		want   []string
+	}{
+		{"", nil, []string{"master"}},
+		{"main,release/*", nil, []string{"main", "release/*"}},
+		{"main", []string{"develop"}, []string{"develop"}},
+	}
+	oldPushBranches := *pushBranches
+	defer func() { *pushBranches = oldPushBranches }()
+	for _, tt := range tests {
+		*pushBranches = tt.flag
+		b := Builder{Config: Config{PushBranches: tt.config}}
+		if got := b.pushBranches(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("pushBranches() with -push-branches %q and %q = %q, want %q",
+				tt.flag, tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestRunsOn(t *testing.T) {
+	tests := []struct {
+		on    []string
+		event string
+		want  bool
+	}{
+		{nil, "push", true},
+		{nil, "pull-request", true},
+		{nil, "tag", false},
+		{[]string{"tag"}, "tag", true},
+		{[]string{"tag"}, "push", false},
+		{[]string{"push", "tag"}, "pull-request", false},
+	}
+	for _, tt := range tests {
+		if got := (TaskConfig{On: tt.on}).runsOn(tt.event); got != tt.want {
+			t.Errorf("runsOn(%s) with on %q = %v, want %v", tt.event, tt.on, got, tt.want)
+		}
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"context"
 	"flag"
+	"fmt"
 	"io"
+	"net/http"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/google/go-github/github"
+	"github.com/google/go-github/v39/github"
 	"github.com/jpillora/backoff"
 	"golang.org/x/oauth2"
 )
@@ -18,6 +20,8 @@ var (
 	githubAccessToken = flag.String("token", os.Getenv("GITHUB_ACCESS_TOKEN"), "The personal access token to manipulate github")
 	gistID            = flag.String("gist", os.Getenv("GIST_ID"), "The ID of the gist")
 	fileName          = flag.String("file-name", os.Getenv("GIST_FILE_NAME"), "The name of the file in the gist")
+	brokerURL         = flag.String("broker-url", os.Getenv("TRIGGR_BROKER_URL"), "The URL of the triggr credential broker, used instead of the token")
+	brokerToken       = flag.String("broker-token", os.Getenv("TRIGGR_TOKEN"), "The token for the triggr credential broker")
 )
 
 var githubClient *github.Client
@@ -97,6 +101,15 @@ func (gw *GistWriter) flush() error {
 		return nil
 	}
 
+	if *brokerURL != "" {
+		if err := gw.flushToBroker(); err != nil {
+			return err
+		}
+		gw.lastFlushTime = time.Now()
+		gw.lastFlushSize = gw.buf.Len()
+		return nil
+	}
+
 	bo := backoff.Backoff{}
 	for {
 		_, resp, err := githubClient.Gists.Edit(gw.Context, gw.ID, &github.Gist{
@@ -121,3 +134,29 @@ func (gw *GistWriter) flush() error {
 	gw.lastFlushSize = gw.buf.Len()
 	return nil
 }
+
+// flushToBroker writes the output to the gist file via the triggr credential
+// broker, which knows which gist and file the task may write.
+func (gw *GistWriter) flushToBroker() error {
+	bo := backoff.Backoff{}
+	for {
+		req, err := http.NewRequest("PUT", *brokerURL+"/gist", bytes.NewReader(gw.buf.Bytes()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+*brokerToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			time.Sleep(bo.Duration())
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("cannot save gist: %s", resp.Status)
+		}
+		return nil
+	}
+}
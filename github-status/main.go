@@ -1,16 +1,19 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"os/exec"
 	"strings"
 
 	"golang.org/x/oauth2"
 
-	"github.com/google/go-github/github"
+	"github.com/google/go-github/v39/github"
 )
 
 var (
@@ -20,6 +23,8 @@ var (
 	targetURL        = flag.String("target-url", os.Getenv("GITHUB_TARGET_URL"), "Target URL")
 	statusContext    = flag.String("context", os.Getenv("GITHUB_STATUS_CONTEXT"), "The name of this application, unique from others")
 	setStatusPending = flag.Bool("set-pending", true, "Mark the job pending")
+	brokerURL        = flag.String("broker-url", os.Getenv("TRIGGR_BROKER_URL"), "The URL of the triggr credential broker, used instead of the token")
+	brokerToken      = flag.String("broker-token", os.Getenv("TRIGGR_TOKEN"), "The token for the triggr credential broker")
 )
 
 var githubClient *github.Client
@@ -49,12 +54,7 @@ func main() {
 		Context:     github.String(*statusContext),
 	}
 	if *setStatusPending {
-		_, _, err := githubClient.Repositories.CreateStatus(ctx,
-			owner,
-			repoName,
-			*rev,
-			status,
-		)
+		err := setStatus(ctx, owner, repoName, status)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "cannot set github status: %v\n", err)
 			os.Exit(1)
@@ -79,12 +79,7 @@ func main() {
 		status.State = github.String("success")
 		status.Description = github.String("success")
 	}
-	_, _, err := githubClient.Repositories.CreateStatus(ctx,
-		owner,
-		repoName,
-		*rev,
-		status,
-	)
+	err := setStatus(ctx, owner, repoName, status)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "cannot set github status: %v\n", err)
 		os.Exit(1)
@@ -92,3 +87,38 @@ func main() {
 
 	os.Exit(exitCode)
 }
+
+// setStatus sets status on the revision, either directly or via the triggr
+// credential broker, which knows the revision and which contexts the task
+// may set.
+func setStatus(ctx context.Context, owner, repoName string, status *github.RepoStatus) error {
+	if *brokerURL == "" {
+		_, _, err := githubClient.Repositories.CreateStatus(ctx,
+			owner,
+			repoName,
+			*rev,
+			status,
+		)
+		return err
+	}
+
+	body, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", *brokerURL+"/status", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+*brokerToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
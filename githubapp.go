@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation"
+	"github.com/google/go-github/v39/github"
+)
+
+// installationTokenLifetime is how long an installation token is used for.
+// Github's last an hour, so this leaves time for the requests made with it.
+const installationTokenLifetime = 50 * time.Minute
+
+// githubApp is set when triggr runs as a github app rather than with a
+// personal access token.
+var githubApp *GithubApp
+
+// GithubApp authenticates to github as the installations of a github app.
+type GithubApp struct {
+	transport *ghinstallation.AppsTransport
+	client    *github.Client // authenticated as the app itself
+
+	mu            sync.Mutex
+	installations map[string]int64          // installation ids, keyed by owner/repo
+	clients       map[int64]*github.Client  // keyed by installation id
+	tokens        map[string]repoTokenEntry // keyed by owner/repo
+}
+
+// repoTokenEntry is an installation token that can only access one
+// repository, and when it stops being used.
+type repoTokenEntry struct {
+	Token   string
+	Expires time.Time
+}
+
+// newGithubApp returns a GithubApp for the app with id, whose private key is
+// in the PEM file keyFile.
+func newGithubApp(id int64, keyFile string) (*GithubApp, error) {
+	transport, err := ghinstallation.NewAppsTransportKeyFromFile(http.DefaultTransport, id, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read private key: %v", err)
+	}
+	return &GithubApp{
+		transport:     transport,
+		client:        github.NewClient(&http.Client{Transport: transport}),
+		installations: map[string]int64{},
+		clients:       map[int64]*github.Client{},
+		tokens:        map[string]repoTokenEntry{},
+	}, nil
+}
+
+// installationID returns the id of the installation of the app that covers
+// owner/repo.
+func (a *GithubApp) installationID(ctx context.Context, owner, repo string) (int64, error) {
+	a.mu.Lock()
+	id, ok := a.installations[owner+"/"+repo]
+	a.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	installation, _, err := a.client.Apps.FindRepositoryInstallation(ctx, owner, repo)
+	if err != nil {
+		return 0, fmt.Errorf("cannot find installation for %s/%s: %v", owner, repo, err)
+	}
+	a.mu.Lock()
+	a.installations[owner+"/"+repo] = installation.GetID()
+	a.mu.Unlock()
+	return installation.GetID(), nil
+}
+
+// Client returns a client authenticated as the installation that covers
+// owner/repo. The client refreshes its installation token as needed.
+func (a *GithubApp) Client(ctx context.Context, owner, repo string) (*github.Client, error) {
+	id, err := a.installationID(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if client, ok := a.clients[id]; ok {
+		return client, nil
+	}
+	client := github.NewClient(&http.Client{
+		Transport: ghinstallation.NewFromAppsTransport(a.transport, id),
+	})
+	a.clients[id] = client
+	return client, nil
+}
+
+// Token returns an installation token that can only access owner/repo. The
+// same token is returned until it is close to expiring.
+func (a *GithubApp) Token(ctx context.Context, owner, repo string) (string, error) {
+	a.mu.Lock()
+	entry, ok := a.tokens[owner+"/"+repo]
+	a.mu.Unlock()
+	if ok && time.Now().Before(entry.Expires) {
+		return entry.Token, nil
+	}
+
+	id, err := a.installationID(ctx, owner, repo)
+	if err != nil {
+		return "", err
+	}
+	token, _, err := a.client.Apps.CreateInstallationToken(ctx, id, &github.InstallationTokenOptions{
+		Repositories: []string{repo},
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot create installation token: %v", err)
+	}
+	a.mu.Lock()
+	a.tokens[owner+"/"+repo] = repoTokenEntry{
+		Token:   token.GetToken(),
+		Expires: time.Now().Add(installationTokenLifetime),
+	}
+	a.mu.Unlock()
+	return token.GetToken(), nil
+}
+
+// repoClient returns a github client that can act on owner/repo.
+func repoClient(ctx context.Context, owner, repo string) (*github.Client, error) {
+	if githubApp == nil {
+		return githubClient, nil
+	}
+	return githubApp.Client(ctx, owner, repo)
+}
+
+// repoToken returns a token that can access owner/repo, which the broker
+// uses on behalf of task pods. For an app this is a token that can't access
+// any other repository.
+func repoToken(ctx context.Context, owner, repo string) (string, error) {
+	if githubApp == nil {
+		return *githubAccessToken, nil
+	}
+	return githubApp.Token(ctx, owner, repo)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func testGithubApp(t *testing.T, handler http.Handler) *GithubApp {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	f.Close()
+
+	app, err := newGithubApp(1, f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	app.client.BaseURL, _ = url.Parse(server.URL + "/")
+	return app
+}
+
+func TestGithubAppToken(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/crewjam/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		fmt.Fprint(w, `{"id": 42}`)
+	})
+	mux.HandleFunc("/app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		var options struct{ Repositories []string }
+		json.NewDecoder(r.Body).Decode(&options)
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"token": "token-for-" + fmt.Sprint(options.Repositories)})
+	})
+	app := testGithubApp(t, mux)
+
+	ctx := context.Background()
+	tests := []struct {
+		repo string
+		want string
+	}{
+		{"triggr", "token-for-[triggr]"},
+		{"triggr", "token-for-[triggr]"},
+		{"saml", "token-for-[saml]"},
+	}
+	for _, tt := range tests {
+		got, err := app.Token(ctx, "crewjam", tt.repo)
+		if err != nil {
+			t.Fatalf("Token(%s) = %v", tt.repo, err)
+		}
+		if got != tt.want {
+			t.Errorf("Token(%s) = %q, want %q", tt.repo, got, tt.want)
+		}
+	}
+	want := map[string]int{
+		"/repos/crewjam/triggr/installation":  1,
+		"/repos/crewjam/saml/installation":    1,
+		"/app/installations/42/access_tokens": 2,
+	}
+	if !reflect.DeepEqual(requests, want) {
+		t.Errorf("requests = %v, want %v", requests, want)
+	}
+}
+
+func TestRepoToken(t *testing.T) {
+	oldToken := *githubAccessToken
+	defer func() { *githubAccessToken = oldToken }()
+	*githubAccessToken = "personal"
+	got, err := repoToken(context.Background(), "crewjam", "triggr")
+	if err != nil || got != "personal" {
+		t.Errorf("repoToken() = %q, %v, want the access token", got, err)
+	}
+}
@@ -0,0 +1,27 @@
+module github.com/crewjam/triggr
+
+go 1.16
+
+require (
+	github.com/BurntSushi/toml v0.3.1
+	github.com/bradleyfalzon/ghinstallation v1.1.1
+	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
+	github.com/google/go-github/v39 v39.2.0
+	github.com/jpillora/backoff v1.0.0
+	github.com/kr/pretty v0.1.0
+	github.com/minio/minio-go v6.0.14+incompatible
+	github.com/robfig/cron v1.2.0
+	goji.io v2.0.2+incompatible
+	golang.org/x/oauth2 v0.0.0-20190604053449-0f29369cfe45
+	k8s.io/api v0.17.17
+	k8s.io/apimachinery v0.17.17
+	k8s.io/client-go v0.17.17
+)
+
+require (
+	github.com/go-ini/ini v1.38.2 // indirect
+	github.com/google/go-github/v29 v29.0.3 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
+	github.com/smartystreets/goconvey v1.6.4 // indirect
+	gopkg.in/ini.v1 v1.67.3 // indirect
+)
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/cache"
+)
+
+// With -task-kind jobs, tasks run as Jobs rather than bare pods. Kubernetes
+// then retries failed pods up to the task's retries, enforces the task's
+// timeout across all the attempts, replaces pods lost with their node, and
+// deletes finished Jobs after -job-ttl. The controller follows the Job's pods
+// to report on a task as it runs, and the Job's conditions to report how it
+// ended.
+
+// jobKeyPrefix marks the keys of Jobs in the controller's queue, which
+// otherwise holds the keys of pods.
+const jobKeyPrefix = "job:"
+
+// runAsJobs returns true if tasks are run as Jobs.
+func runAsJobs() bool {
+	return *taskKind == "jobs"
+}
+
+// jobTTL returns how long finished Jobs are kept.
+func jobTTL() (time.Duration, error) {
+	if *jobTTLFlag == "" {
+		return time.Hour, nil
+	}
+	d, err := time.ParseDuration(*jobTTLFlag)
+	if err != nil {
+		return 0, fmt.Errorf("invalid -job-ttl: %v", err)
+	}
+	return d, nil
+}
+
+// maxJobName is the longest name a Job can have, since kubernetes puts it in
+// the job-name label of its pods.
+const maxJobName = 63
+
+// shortName returns name if it is short enough to name a Job, or else as
+// much of it as fits along with a hash of the whole. Task pods are named this
+// way too, so that a task's pod and Job have the same name.
+func shortName(name string) string {
+	return truncateName(name, maxJobName)
+}
+
+// truncateName returns name if it is no longer than max, or else as much of
+// it as fits along with a hash of the whole. Either way, the name doesn't end
+// in a dash or a dot, which kubernetes doesn't allow.
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return strings.TrimRight(name, "-.")
+	}
+	hash := sha256.Sum256([]byte(name))
+	suffix := "-" + hex.EncodeToString(hash[:])[:8]
+	return strings.TrimRight(name[:max-len(suffix)], "-.") + suffix
+}
+
+// canRunAsJob returns true if pod can be run as a Job. Service containers and
+// the collector keep running after the exec container is done, so the pod of
+// a Job that has them would never finish. Kubernetes retries the pods of a
+// Job however they fail, which doesn't fit with the task's retry-on, so tasks
+// with retries are left to the controller too. Such tasks are run as bare
+// pods.
+func canRunAsJob(pod *v1.Pod) bool {
+	if _, ok := pod.ObjectMeta.Annotations["triggr.crewjam.com/retries"]; ok {
+		return false
+	}
+	return runAsJobs() && len(pod.Spec.Containers) == 1
+}
+
+// createJob creates a Job that runs pod once.
+func createJob(pod *v1.Pod) (*batchv1.Job, error) {
+	ttl, err := jobTTL()
+	if err != nil {
+		return nil, err
+	}
+	ttlSeconds := int32(ttl / time.Second)
+	backoffLimit := int32(0)
+
+	// the timeout is the job's, so that it counts from when the job starts
+	spec := *pod.Spec.DeepCopy()
+	spec.ActiveDeadlineSeconds = nil
+
+	return kubeClient.BatchV1().Jobs(*kubeNamespace).Create(&batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            shortName(pod.GetName()),
+			Labels:          pod.GetObjectMeta().GetLabels(),
+			Annotations:     pod.GetObjectMeta().GetAnnotations(),
+			OwnerReferences: pod.GetObjectMeta().GetOwnerReferences(),
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			ActiveDeadlineSeconds:   pod.Spec.ActiveDeadlineSeconds,
+			TTLSecondsAfterFinished: &ttlSeconds,
+			Template: v1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      pod.GetObjectMeta().GetLabels(),
+					Annotations: pod.GetObjectMeta().GetAnnotations(),
+				},
+				Spec: spec,
+			},
+		},
+	})
+}
+
+// jobFinished returns true if job has completed or failed.
+func jobFinished(job *batchv1.Job) bool {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status == v1.ConditionTrue &&
+			(condition.Type == batchv1.JobComplete || condition.Type == batchv1.JobFailed) {
+			return true
+		}
+	}
+	return false
+}
+
+// jobState returns the github state of the task run by job, given the most
+// recent of its pods, which may be nil.
+func jobState(job *batchv1.Job, pod *v1.Pod) (state, description string) {
+	for _, condition := range job.Status.Conditions {
+		if condition.Status != v1.ConditionTrue {
+			continue
+		}
+		switch condition.Type {
+		case batchv1.JobComplete:
+			return "success", "success"
+		case batchv1.JobFailed:
+			if condition.Reason == "DeadlineExceeded" {
+				// either the task timeout or stopJob
+				if reason := job.GetAnnotations()["triggr.crewjam.com/timed-out"]; reason != "" {
+					return "error", reason
+				}
+				return "error", "timed out after " + job.GetAnnotations()["triggr.crewjam.com/timeout"]
+			}
+			if pod != nil {
+				if state, description := podState(pod); state != "pending" {
+					return state, description
+				}
+			}
+			if condition.Message != "" {
+				return "failure", condition.Message
+			}
+			return "failure", "failure"
+		}
+	}
+	return "pending", "pending"
+}
+
+// jobPods returns the pods of job that the controller knows of, oldest
+// first.
+func (c *Controller) jobPods(job *batchv1.Job) []*v1.Pod {
+	rv := []*v1.Pod{}
+	for _, obj := range c.indexer.List() {
+		pod := obj.(*v1.Pod)
+		if pod.GetNamespace() == job.GetNamespace() && pod.GetObjectMeta().GetLabels()["job-name"] == job.GetName() {
+			rv = append(rv, pod)
+		}
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].CreationTimestamp.Before(&rv[j].CreationTimestamp)
+	})
+	return rv
+}
+
+// jobPod stands in for the pods of job when none of them are left, so that
+// the status of the task can still be set.
+func jobPod(job *batchv1.Job) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        job.GetName(),
+			Namespace:   job.GetNamespace(),
+			Labels:      job.Spec.Template.GetLabels(),
+			Annotations: job.GetAnnotations(),
+		},
+		Spec: job.Spec.Template.Spec,
+	}
+}
+
+// getJob returns the Job called name that the controller knows of, or nil.
+func (c *Controller) getJob(namespace, name string) *batchv1.Job {
+	if c.jobIndexer == nil {
+		return nil
+	}
+	obj, exists, err := c.jobIndexer.GetByKey(namespace + "/" + name)
+	if err != nil || !exists {
+		return nil
+	}
+	return obj.(*batchv1.Job)
+}
+
+// syncJob reports how the task run by the Job named by key ended, once the
+// Job has finished. Until then, it reports each pod that failed and is being
+// tried again.
+func (c *Controller) syncJob(key string) error {
+	ctx := context.Background()
+	key = strings.TrimPrefix(key, jobKeyPrefix)
+
+	obj, exists, err := c.jobIndexer.GetByKey(key)
+	if err != nil {
+		glog.Errorf("Fetching object with key %s from store failed with %v", key, err)
+		return err
+	}
+	if !exists {
+		return c.jobDeleted(ctx, key)
+	}
+
+	job := obj.(*batchv1.Job)
+	log.Printf("namespace: %s job: %s", job.GetNamespace(), job.GetName())
+	annotations := job.GetAnnotations()
+	if annotations["triggr.crewjam.com/github-status-context"] == "" {
+		return nil
+	}
+	if annotations["triggr.crewjam.com/cancelled"] != "" {
+		return nil
+	}
+	if annotations["triggr.crewjam.com/github-last-status"] != "pending" {
+		return nil
+	}
+
+	pods := c.jobPods(job)
+	var pod *v1.Pod
+	if len(pods) > 0 {
+		pod = pods[len(pods)-1]
+	}
+	state, description := jobState(job, pod)
+	if state == "pending" {
+		return c.reportJobRetry(ctx, job, pods)
+	}
+
+	var out []byte
+	if pod != nil {
+		out, err = podOutput(pod)
+		if err != nil {
+			glog.Errorf("%s: %v", pod.GetName(), err)
+		}
+	} else {
+		pod = jobPod(job)
+	}
+	return c.finishJob(ctx, key, job, pod, state, description, out)
+}
+
+// reportJobRetry sets a pending status that says the task is being tried
+// again when another of job's pods has failed, but the Job hasn't given up.
+func (c *Controller) reportJobRetry(ctx context.Context, job *batchv1.Job, pods []*v1.Pod) error {
+	annotations := job.GetAnnotations()
+	reported, _ := strconv.Atoi(annotations["triggr.crewjam.com/failed-attempts"])
+	failed := int(job.Status.Failed)
+	if failed <= reported {
+		return nil
+	}
+
+	description := "failed"
+	for i := len(pods) - 1; i >= 0; i-- {
+		if pods[i].Status.Phase == v1.PodFailed {
+			_, description = podState(pods[i])
+			break
+		}
+	}
+	pod := jobPod(job)
+	if len(pods) > 0 {
+		pod = pods[len(pods)-1]
+	}
+	attempts := 1
+	if job.Spec.BackoffLimit != nil {
+		attempts += int(*job.Spec.BackoffLimit)
+	}
+	description = fmt.Sprintf("retrying after %s (attempt %d of %d)", description, failed+1, attempts)
+	if err := setPodStatus(ctx, pod, "pending", description, nil); err != nil {
+		return err
+	}
+	return annotateJob(job, "triggr.crewjam.com/failed-attempts", strconv.Itoa(failed))
+}
+
+// annotateJob sets an annotation of job. The Job is patched rather than
+// updated, since job is the controller's copy, which may be out of date.
+func annotateJob(job *batchv1.Job, key, value string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = kubeClient.BatchV1().Jobs(job.GetNamespace()).Patch(job.GetName(), types.MergePatchType, patch)
+	if err != nil {
+		glog.Errorf("cannot update job: %v", err)
+		return err
+	}
+	return nil
+}
+
+// finishJob reports that the task run by job ended in state, pod being the
+// most recent of its pods. Kubernetes deletes the Job after -job-ttl.
+func (c *Controller) finishJob(ctx context.Context, key string, job *batchv1.Job, pod *v1.Pod, state, description string, out []byte) error {
+	if out != nil {
+		if err := savePodOutput(ctx, pod, out); err != nil {
+			return err
+		}
+	}
+	if err := setPodStatus(ctx, pod, state, description, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: set state to %s\n", job.GetName(), state)
+	if err := startDependents(ctx, pod); err != nil {
+		glog.Errorf("cannot start dependent tasks: %v", err)
+		return err
+	}
+	revokeBrokerToken(job.GetAnnotations()["triggr.crewjam.com/broker-secret"])
+	buildQueue.PodStopped(key)
+	return annotateJob(job, "triggr.crewjam.com/github-last-status", state)
+}
+
+// failJob ends the task run by the Job of pod, which can't start, and so
+// would otherwise keep the Job from ever finishing.
+func (c *Controller) failJob(ctx context.Context, pod *v1.Pod, state, description string) error {
+	job := c.getJob(pod.GetNamespace(), pod.GetObjectMeta().GetLabels()["job-name"])
+	if job == nil || job.GetAnnotations()["triggr.crewjam.com/github-last-status"] != "pending" {
+		return nil
+	}
+	key := job.GetNamespace() + "/" + job.GetName()
+	if err := c.finishJob(ctx, key, job, pod, state, description, nil); err != nil {
+		return err
+	}
+	fmt.Printf("%s: deleted job\n", job.GetName())
+	return c.deleteJob(key, job)
+}
+
+// deleteJob deletes job and its pods, which the controller has finished with.
+func (c *Controller) deleteJob(key string, job *batchv1.Job) error {
+	c.mu.Lock()
+	c.deleting[jobKeyPrefix+key] = true
+	c.mu.Unlock()
+	propagation := metav1.DeletePropagationBackground
+	err := kubeClient.BatchV1().Jobs(job.GetNamespace()).Delete(job.GetName(), &metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		c.mu.Lock()
+		delete(c.deleting, jobKeyPrefix+key)
+		c.mu.Unlock()
+		glog.Errorf("cannot delete job: %v", err)
+		return err
+	}
+	return nil
+}
+
+// jobGone records the last seen state of a Job that has been deleted, for
+// jobDeleted.
+func (c *Controller) jobGone(key string, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	job, ok := obj.(*batchv1.Job)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	c.deletedJobs[key] = job
+	c.mu.Unlock()
+}
+
+// jobDeleted handles a Job that has been deleted. If it was deleted before it
+// finished, by someone other than the controller, the status of its task is
+// set to error.
+func (c *Controller) jobDeleted(ctx context.Context, key string) error {
+	c.mu.Lock()
+	job := c.deletedJobs[key]
+	deleting := c.deleting[jobKeyPrefix+key]
+	delete(c.deletedJobs, key)
+	delete(c.deleting, jobKeyPrefix+key)
+	c.mu.Unlock()
+	if job == nil || deleting {
+		return nil
+	}
+
+	annotations := job.GetAnnotations()
+	if annotations["triggr.crewjam.com/github-status-context"] == "" {
+		return nil
+	}
+	if annotations["triggr.crewjam.com/cancelled"] != "" {
+		return nil
+	}
+	if annotations["triggr.crewjam.com/github-last-status"] != "pending" {
+		return nil
+	}
+	log.Printf("%s: job was deleted", job.GetName())
+
+	pod := jobPod(job)
+	if pods := c.jobPods(job); len(pods) > 0 {
+		pod = pods[len(pods)-1]
+	}
+	revokeBrokerToken(annotations["triggr.crewjam.com/broker-secret"])
+	if err := setPodStatus(ctx, pod, "error", "task job was deleted before completion", nil); err != nil {
+		return err
+	}
+	return startDependents(ctx, pod)
+}
+
+// stopJob fails the Job that runs pod by moving its deadline up to now, for
+// the reason given. Stopping just the pod would only make the Job try again.
+func stopJob(pod *v1.Pod, reason string) error {
+	name := pod.GetObjectMeta().GetLabels()["job-name"]
+	job, err := kubeClient.BatchV1().Jobs(pod.GetNamespace()).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot fetch job %s: %v", name, err)
+	}
+	deadline := int64(1)
+	if job.Status.StartTime != nil {
+		deadline += int64(time.Since(job.Status.StartTime.Time) / time.Second)
+	}
+	if job.Spec.ActiveDeadlineSeconds != nil && *job.Spec.ActiveDeadlineSeconds < deadline {
+		return nil
+	}
+	job.Spec.ActiveDeadlineSeconds = &deadline
+	job.ObjectMeta.Annotations["triggr.crewjam.com/timed-out"] = reason
+	if _, err := kubeClient.BatchV1().Jobs(job.GetNamespace()).Update(job); err != nil {
+		return fmt.Errorf("cannot update job %s: %v", name, err)
+	}
+	glog.Infof("%s: %s", job.GetName(), reason)
+	return nil
+}
+
+// cancelJob stops the Job that runs pod, which would otherwise replace the
+// pod when it is deleted. The Job is marked as cancelled first so that the
+// controller leaves its status alone.
+func cancelJob(pod *v1.Pod, description string) error {
+	name := pod.GetObjectMeta().GetLabels()["job-name"]
+	job, err := kubeClient.BatchV1().Jobs(pod.GetNamespace()).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot fetch job %s: %v", name, err)
+	}
+	job.ObjectMeta.Annotations["triggr.crewjam.com/cancelled"] = description
+	if _, err := kubeClient.BatchV1().Jobs(job.GetNamespace()).Update(job); err != nil {
+		return fmt.Errorf("cannot update job %s: %v", name, err)
+	}
+	propagation := metav1.DeletePropagationBackground
+	err = kubeClient.BatchV1().Jobs(job.GetNamespace()).Delete(name, &metav1.DeleteOptions{
+		PropagationPolicy: &propagation,
+	})
+	if err != nil {
+		return fmt.Errorf("cannot delete job %s: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTruncateName(t *testing.T) {
+	hash := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])[:8]
+	}
+	a70 := strings.Repeat("a", 70)
+	dotted := strings.Repeat("a", 53) + "-.xxxxxxxxxx"
+	tests := []struct {
+		name string
+		max  int
+		want string
+	}{
+		{"triggr-crewjam-triggr-0123456789ab-test", 63, "triggr-crewjam-triggr-0123456789ab-test"},
+		{"test--go-", 63, "test--go"},
+		{a70, 70, a70},
+		{a70, 63, a70[:54] + "-" + hash(a70)},
+		{dotted, 63, strings.Repeat("a", 53) + "-" + hash(dotted)},
+	}
+	for _, tt := range tests {
+		got := truncateName(tt.name, tt.max)
+		if got != tt.want {
+			t.Errorf("truncateName(%q, %d) = %q, want %q", tt.name, tt.max, got, tt.want)
+		}
+		if len(got) > tt.max {
+			t.Errorf("truncateName(%q, %d) is %d characters long", tt.name, tt.max, len(got))
+		}
+	}
+}
+
+func TestCanRunAsJob(t *testing.T) {
+	pod := func(retries bool, containers ...string) *v1.Pod {
+		rv := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}}}
+		if retries {
+			rv.ObjectMeta.Annotations["triggr.crewjam.com/retries"] = "2"
+			rv.ObjectMeta.Annotations["triggr.crewjam.com/retry-on"] = "evicted,image-pull"
+		}
+		for _, name := range containers {
+			rv.Spec.Containers = append(rv.Spec.Containers, v1.Container{Name: name})
+		}
+		return rv
+	}
+	tests := []struct {
+		name     string
+		taskKind string
+		pod      *v1.Pod
+		want     bool
+	}{
+		{"pods", "pods", pod(false, "exec"), false},
+		{"jobs", "jobs", pod(false, "exec"), true},
+		{"services", "jobs", pod(false, "exec", "postgres"), false},
+		{"collector", "jobs", pod(false, "exec", "collector"), false},
+		{"retries", "jobs", pod(true, "exec"), false},
+	}
+	oldTaskKind := *taskKind
+	defer func() { *taskKind = oldTaskKind }()
+	for _, tt := range tests {
+		*taskKind = tt.taskKind
+		if got := canRunAsJob(tt.pod); got != tt.want {
+			t.Errorf("%s: canRunAsJob() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
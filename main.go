@@ -5,10 +5,12 @@ import (
 	"flag"
 	"log"
 	"os"
+	"strconv"
 
-	"github.com/google/go-github/github"
+	"github.com/google/go-github/v39/github"
 	"golang.org/x/oauth2"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -19,21 +21,91 @@ var (
 	githubAccessToken = flag.String("github-access-token",
 		os.Getenv("GITHUB_ACCESS_TOKEN"),
 		"The personal access token to manipulate github")
+	githubAppID = flag.String("github-app-id",
+		os.Getenv("GITHUB_APP_ID"),
+		"The id of the github app to run as, instead of using a personal access token")
+	githubAppPrivateKey = flag.String("github-app-private-key",
+		os.Getenv("GITHUB_APP_PRIVATE_KEY"),
+		"The path to the PEM encoded private key of the github app")
 	githubWebhookSecret = flag.String("github-webhook-secret",
 		os.Getenv("GITHUB_WEBHOOK_SECRET"),
 		"the github webhook secret")
 	statusContext = flag.String("github-status-context",
 		os.Getenv("GITHUB_STATUS_CONTEXT"),
 		"The name of this application, unique from others")
+	githubReporter = flag.String("github-reporter",
+		os.Getenv("GITHUB_REPORTER"),
+		"How task results are reported, either statuses or checks (default statuses)")
+	pushBranches = flag.String("push-branches",
+		os.Getenv("PUSH_BRANCHES"),
+		"Comma separated patterns of the branches whose pushes are built (default master)")
+	scheduleRepos = flag.String("schedule-repos",
+		os.Getenv("SCHEDULE_REPOS"),
+		"Comma separated list of repositories (owner/name) whose scheduled tasks are run")
+	brokerURLFlag = flag.String("broker-url",
+		os.Getenv("BROKER_URL"),
+		"The URL at which task pods reach this server (default http://triggr.default.svc.cluster.local)")
+	okToTestLabelFlag = flag.String("ok-to-test-label",
+		os.Getenv("OK_TO_TEST_LABEL"),
+		"The label with which maintainers approve building untrusted pull requests (default ok-to-test)")
+	untrustedPrivileges = flag.String("untrusted-privileges",
+		os.Getenv("UNTRUSTED_PRIVILEGES"),
+		"Comma separated privileges that approved untrusted pull requests get anyway: secrets, map-docker-sock")
+	taskKind = flag.String("task-kind",
+		os.Getenv("TASK_KIND"),
+		"How tasks are run, either pods or jobs (default pods)")
+	jobTTLFlag = flag.String("job-ttl",
+		os.Getenv("JOB_TTL"),
+		"How long kubernetes keeps the jobs of finished tasks, with -task-kind jobs (default 1h)")
+	buildRetentionFlag = flag.String("build-retention",
+		os.Getenv("BUILD_RETENTION"),
+		"How long finished builds are kept, or 0 to keep them forever (default 720h)")
 	kubeNamespace = flag.String("namespace",
 		os.Getenv("K8S_NAMESPACE"),
 		"The kubernetes namespace to use")
+	checkoutImage = flag.String("checkout-image",
+		os.Getenv("CHECKOUT_IMAGE"),
+		"The image used to check out the source for tasks, which needs git and git-lfs (default alpine/git)")
+	helperImage = flag.String("helper-image",
+		os.Getenv("HELPER_IMAGE"),
+		"The image used for helper containers in task pods, which needs sh and tar (default busybox)")
+	artifactStoreURL = flag.String("artifact-store",
+		os.Getenv("ARTIFACT_STORE"),
+		"Where to keep artifacts, either file:///some/directory or s3://bucket/prefix")
+	artifactURL = flag.String("artifact-url",
+		os.Getenv("ARTIFACT_URL"),
+		"The external URL of this server, used to link to artifacts")
+	s3Endpoint = flag.String("s3-endpoint",
+		os.Getenv("S3_ENDPOINT"),
+		"The URL of the S3 compatible service for an s3 artifact store (default https://s3.amazonaws.com)")
+	cacheClaim = flag.String("cache-claim",
+		os.Getenv("CACHE_CLAIM"),
+		"The persistent volume claim where task caches are kept")
+	maxCPU = flag.String("max-cpu",
+		os.Getenv("MAX_CPU"),
+		"The most CPU a task may request, and the CPU limit of each container of its pod")
+	maxMemory = flag.String("max-memory",
+		os.Getenv("MAX_MEMORY"),
+		"The most memory a task may request, and the memory limit of each container of its pod")
+	maxEphemeralStorage = flag.String("max-ephemeral-storage",
+		os.Getenv("MAX_EPHEMERAL_STORAGE"),
+		"The most ephemeral storage a task may request, and the ephemeral storage limit of each container of its pod")
+	maxRunning = flag.String("max-running",
+		os.Getenv("MAX_RUNNING"),
+		"The most task pods that may run at once")
+	maxRunningPerRepo = flag.String("max-running-per-repo",
+		os.Getenv("MAX_RUNNING_PER_REPO"),
+		"The most task pods of one repository that may run at once")
+	maxRunningPerOwner = flag.String("max-running-per-owner",
+		os.Getenv("MAX_RUNNING_PER_OWNER"),
+		"The most task pods of the repositories of one owner that may run at once")
 	kubeConfigPath = flag.String("kubeconfig", "",
 		"absolute path to the kubeconfig file")
 	kubeMasterURL = flag.String("master", "",
 		"master url")
 	githubClient *github.Client
 	kubeClient   *kubernetes.Clientset
+	kubeConfig   *rest.Config
 )
 
 func main() {
@@ -41,18 +113,42 @@ func main() {
 
 	// initialize kubernetes client
 	{
-		config, err := clientcmd.BuildConfigFromFlags(*kubeMasterURL, *kubeConfigPath)
+		var err error
+		kubeConfig, err = clientcmd.BuildConfigFromFlags(*kubeMasterURL, *kubeConfigPath)
 		if err != nil {
 			log.Fatalf("cannot create k8s config: %v", err)
 		}
-		kubeClient, err = kubernetes.NewForConfig(config)
+		kubeClient, err = kubernetes.NewForConfig(kubeConfig)
 		if err != nil {
 			log.Fatalf("cannot create k8s client: %v", err)
 		}
+		triggrClient, err = newTriggrClient(kubeConfig)
+		if err != nil {
+			log.Fatalf("cannot create k8s client: %v", err)
+		}
+		if _, err := listBuilds(""); err != nil {
+			log.Printf("cannot list builds, so builds won't be recorded. Are the resources in crds.yaml installed? %v", err)
+		} else {
+			crdsInstalled = true
+		}
 	}
 
-	// initialize github client
-	{
+	// initialize github client. When running as an app, the personal access
+	// token is optional and only used for gists.
+	if *githubAppID != "" {
+		id, err := strconv.ParseInt(*githubAppID, 10, 64)
+		if err != nil {
+			log.Fatalf("invalid -github-app-id %q", *githubAppID)
+		}
+		githubApp, err = newGithubApp(id, *githubAppPrivateKey)
+		if err != nil {
+			log.Fatalf("cannot create github app: %v", err)
+		}
+		if _, _, err := githubApp.client.Apps.Get(context.Background(), ""); err != nil {
+			log.Fatalf("cannot connect to github: %v", err)
+		}
+	}
+	if *githubAccessToken != "" {
 		githubClient = github.NewClient(
 			oauth2.NewClient(context.Background(),
 				oauth2.StaticTokenSource(
@@ -64,6 +160,45 @@ func main() {
 			log.Fatalf("cannot connect to github: %v", err)
 		}
 	}
+	if githubApp == nil && githubClient == nil {
+		log.Fatalf("either -github-access-token or -github-app-id is required")
+	}
+
+	// initialize the artifact store
+	if *artifactStoreURL != "" {
+		if *s3Endpoint == "" {
+			*s3Endpoint = "https://s3.amazonaws.com"
+		}
+		var err error
+		artifactStore, err = newArtifactStore(*artifactStoreURL)
+		if err != nil {
+			log.Fatalf("cannot create artifact store: %v", err)
+		}
+	}
+
+	if *githubReporter != "" && *githubReporter != "statuses" && !reportChecks() {
+		log.Fatalf("invalid -github-reporter %q", *githubReporter)
+	}
+	if reportChecks() && githubApp == nil {
+		log.Fatalf("-github-reporter checks requires -github-app-id, since only a github app can create check runs")
+	}
+
+	if *taskKind != "" && *taskKind != "pods" && !runAsJobs() {
+		log.Fatalf("invalid -task-kind %q", *taskKind)
+	}
+	if _, err := jobTTL(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	if _, err := buildRetention(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	if err := parseQueueLimits(); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	// start the build queue
+	go buildQueue.Run(context.Background())
 
 	// start the kubernetes controller
 	go runController()
@@ -71,6 +206,12 @@ func main() {
 	// start the hook server
 	go runServer()
 
+	// start the scheduler
+	go runScheduler()
+
+	// delete old builds
+	go runBuildCollector()
+
 	// wait forever
 	select {}
 }
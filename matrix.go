@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// checkMatrix makes sure that every matrix key of every task has at least
+// one value, since otherwise the task would quietly have no variants.
+func (c *Config) checkMatrix() error {
+	for _, task := range c.Tasks {
+		for _, key := range sortedMatrixKeys(task.Matrix) {
+			if len(task.Matrix[key]) == 0 {
+				return fmt.Errorf("task %s has no values for matrix key %s", task.Name, key)
+			}
+		}
+	}
+	return nil
+}
+
+// checkTaskIDs makes sure that the tasks produced by expandMatrix still have
+// distinct IDs once they are made safe for pod names, which they are part of.
+func checkTaskIDs(tasks []TaskConfig) error {
+	seen := map[string]string{}
+	for _, task := range tasks {
+		id := podNameSafe(task.ID())
+		if other, ok := seen[id]; ok {
+			return fmt.Errorf("tasks %s and %s would have the same pod name", other, task.ID())
+		}
+		seen[id] = task.ID()
+	}
+	return nil
+}
+
+// expandMatrix replaces each task that has a matrix with one copy of the
+// task for every combination of the matrix values.
+func expandMatrix(tasks []TaskConfig) []TaskConfig {
+	rv := []TaskConfig{}
+	for _, task := range tasks {
+		if len(task.Matrix) == 0 {
+			rv = append(rv, task)
+			continue
+		}
+
+		variants := []map[string]string{{}}
+		for _, key := range sortedMatrixKeys(task.Matrix) {
+			next := []map[string]string{}
+			for _, variant := range variants {
+				for _, value := range task.Matrix[key] {
+					v := map[string]string{key: value}
+					for k, value := range variant {
+						v[k] = value
+					}
+					next = append(next, v)
+				}
+			}
+			variants = next
+		}
+
+		for _, variant := range variants {
+			t := task
+			t.Variant = variant
+			rv = append(rv, t)
+		}
+	}
+	return rv
+}
+
+func sortedMatrixKeys(m map[string][]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ID returns a name for the task that is unique among the variants produced
+// by expandMatrix, e.g. "test-1.21-amd64".
+func (t TaskConfig) ID() string {
+	parts := []string{t.Name}
+	for _, key := range sortedKeys(t.Variant) {
+		parts = append(parts, t.Variant[key])
+	}
+	return strings.Join(parts, "-")
+}
+
+// matrixEnvName returns the name of the environment variable that holds the
+// value of the matrix key, e.g. MATRIX_GO for "go".
+func matrixEnvName(key string) string {
+	return "MATRIX_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// podNameSafe returns s with everything that may not appear in the name of
+// a pod replaced by a dash.
+func podNameSafe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return r - 'A' + 'a'
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		}
+		return '-'
+	}, s)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := []string{}
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
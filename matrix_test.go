@@ -0,0 +1,90 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name  string
+		tasks []TaskConfig
+		want  []string
+	}{
+		{"no matrix", []TaskConfig{{Name: "lint"}}, []string{"lint"}},
+		{"one key", []TaskConfig{{Name: "test", Matrix: map[string][]string{
+			"go": {"1.20", "1.21"},
+		}}}, []string{"test-1.20", "test-1.21"}},
+		{"two keys", []TaskConfig{{Name: "test", Matrix: map[string][]string{
+			"os": {"linux", "darwin"},
+			"go": {"1.20", "1.21"},
+		}}}, []string{"test-1.20-linux", "test-1.20-darwin", "test-1.21-linux", "test-1.21-darwin"}},
+		{"mixed", []TaskConfig{
+			{Name: "lint"},
+			{Name: "test", Matrix: map[string][]string{"go": {"1.21"}}},
+		}, []string{"lint", "test-1.21"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, task := range expandMatrix(tt.tasks) {
+			got = append(got, task.ID())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expandMatrix() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCheckMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  map[string][]string
+		wantErr bool
+	}{
+		{"none", nil, false},
+		{"values", map[string][]string{"go": {"1.21"}}, false},
+		{"no values", map[string][]string{"go": {"1.21"}, "os": {}}, true},
+	}
+	for _, tt := range tests {
+		c := &Config{Tasks: []TaskConfig{{Name: "test", Matrix: tt.matrix}}}
+		if err := c.checkMatrix(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkMatrix() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckTaskIDs(t *testing.T) {
+	variant := func(name, value string) TaskConfig {
+		return TaskConfig{Name: name, Variant: map[string]string{"v": value}}
+	}
+	tests := []struct {
+		name    string
+		tasks   []TaskConfig
+		wantErr bool
+	}{
+		{"distinct", []TaskConfig{variant("test", "a"), variant("test", "b")}, false},
+		{"same pod name", []TaskConfig{variant("test", "A B"), variant("test", "a-b")}, true},
+		{"same as another task", []TaskConfig{{Name: "test-a"}, variant("test", "a")}, true},
+	}
+	for _, tt := range tests {
+		if err := checkTaskIDs(tt.tasks); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkTaskIDs() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMatrixEnvName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"go", "MATRIX_GO"},
+		{"node-version", "MATRIX_NODE_VERSION"},
+		{"Python3", "MATRIX_PYTHON3"},
+	}
+	for _, tt := range tests {
+		if got := matrixEnvName(tt.key); got != tt.want {
+			t.Errorf("matrixEnvName(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+// waitingPrefix starts the description of the pending status we set for
+// tasks that are waiting for other tasks to finish.
+const waitingPrefix = "waiting for "
+
+// checkNeeds makes sure that every task named in a `needs` list exists and
+// that the tasks do not depend on each other in a cycle.
+func (c *Config) checkNeeds() error {
+	tasks := map[string]TaskConfig{}
+	for _, task := range c.Tasks {
+		tasks[task.Name] = task
+	}
+	for _, task := range c.Tasks {
+		for _, need := range task.Needs {
+			if _, ok := tasks[need]; !ok {
+				return fmt.Errorf("task %s needs unknown task %s", task.Name, need)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("task %s depends on itself", name)
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, need := range tasks[name].Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, task := range c.Tasks {
+		if err := visit(task.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitTask marks task as pending until the tasks it needs have finished. The
+// controller starts it via startReady.
+func (b *Builder) waitTask(ctx context.Context, task TaskConfig) error {
+	description := waitingPrefix + strings.Join(task.Needs, ", ")
+	if err := b.reportStatus(ctx, task, "pending", description); err != nil {
+		return err
+	}
+	return b.updateTaskRuns(task, func(s *TaskRunStatus) {
+		s.Phase = phaseWaiting
+		s.State = "pending"
+		s.Description = description
+	})
+}
+
+// taskRunStatuses returns the status of each task at the revision being
+// built, keyed by status context. A task that has run more than once, e.g.
+// because it was retested, has the status of its most recent TaskRun.
+func (b *Builder) taskRunStatuses() (map[string]TaskRunStatus, error) {
+	taskRuns, err := listTaskRuns(fmt.Sprintf("owner=%s,repo=%s,sha=%s",
+		b.Owner, b.Repo.GetName(), b.SHA))
+	if err != nil {
+		return nil, fmt.Errorf("cannot list task runs: %v", err)
+	}
+	latest := map[string]*TaskRun{}
+	for i := range taskRuns.Items {
+		taskRun := &taskRuns.Items[i]
+		prev, ok := latest[taskRun.Spec.StatusContext]
+		switch {
+		case !ok, prev.CreationTimestamp.Before(&taskRun.CreationTimestamp):
+		case prev.CreationTimestamp.Equal(&taskRun.CreationTimestamp) &&
+			taskRun.Spec.Build == b.BuildName:
+			// the timestamps only go to the second
+		default:
+			continue
+		}
+		latest[taskRun.Spec.StatusContext] = taskRun
+	}
+	rv := map[string]TaskRunStatus{}
+	for context, taskRun := range latest {
+		rv[context] = taskRun.Status
+	}
+	return rv, nil
+}
+
+// githubStates returns the github state of each task at the revision being
+// built, keyed by status context.
+func (b *Builder) githubStates(ctx context.Context) (map[string]string, error) {
+	rv := map[string]string{}
+	if reportChecks() {
+		runs, err := listCheckRuns(ctx, b.Owner, b.Repo.GetName(), b.SHA, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, run := range runs {
+			if _, ok := rv[run.GetName()]; !ok {
+				rv[run.GetName()] = checkRunState(run)
+			}
+		}
+		return rv, nil
+	}
+
+	client, err := b.client(ctx)
+	if err != nil {
+		return nil, err
+	}
+	opts := &github.ListOptions{PerPage: 100}
+	for {
+		combined, resp, err := client.Repositories.GetCombinedStatus(ctx,
+			b.Owner,
+			b.Repo.GetName(),
+			b.SHA,
+			opts)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch status: %v", err)
+		}
+		for _, status := range combined.Statuses {
+			rv[status.GetContext()] = status.GetState()
+		}
+		if resp.NextPage == 0 {
+			break
+		}
+		opts.Page = resp.NextPage
+	}
+	return rv, nil
+}
+
+// needStatuses returns the statuses that startReady goes by, keyed by status
+// context. They come from the TaskRuns at the revision being built, which
+// include the tasks of earlier builds, e.g. when only some tasks are being
+// retested. If the TaskRuns of a task that is needed have been deleted
+// already, its github state is used instead.
+func (b *Builder) needStatuses(ctx context.Context) (map[string]TaskRunStatus, error) {
+	statuses, err := b.taskRunStatuses()
+	if err != nil {
+		return nil, err
+	}
+	needed := map[string]bool{}
+	for _, task := range b.Config.Tasks {
+		for _, need := range task.Needs {
+			needed[need] = true
+		}
+	}
+	for _, task := range b.Config.allTasks() {
+		if _, ok := statuses[b.statusContext(task)]; ok || !needed[task.Name] {
+			continue
+		}
+		states, err := b.githubStates(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for context, state := range states {
+			if _, ok := statuses[context]; !ok {
+				statuses[context] = TaskRunStatus{Phase: taskRunPhase(state, ""), State: state}
+			}
+		}
+		break
+	}
+	return statuses, nil
+}
+
+// startReady starts each waiting task whose dependencies have all succeeded
+// and marks as skipped each waiting task with a dependency that did not.
+func (b *Builder) startReady(ctx context.Context) error {
+	statuses, err := b.needStatuses(ctx)
+	if err != nil {
+		return err
+	}
+
+	// skipping a task can make the tasks that need it skippable in turn,
+	// so keep going until nothing changes.
+	for changed := true; changed; {
+		changed = false
+		for _, task := range b.Config.Tasks {
+			context := b.statusContext(task)
+			if statuses[context].Phase != phaseWaiting {
+				continue
+			}
+
+			ready := true
+			failed := ""
+			for _, need := range task.Needs {
+				switch b.needPhase(statuses, need) {
+				case phaseSucceeded:
+				case phaseFailed:
+					failed = need
+				default:
+					ready = false
+				}
+			}
+
+			switch {
+			case failed != "":
+				if err := b.skipForNeed(ctx, task, failed); err != nil {
+					return err
+				}
+				statuses[context] = TaskRunStatus{Phase: phaseSkipped, SkippedFor: failed}
+				changed = true
+			case ready:
+				err := b.updateTaskRuns(task, func(s *TaskRunStatus) {
+					s.Phase = phaseQueued
+				})
+				if err != nil {
+					return err
+				}
+				if err := b.startTask(ctx, task); err != nil {
+					return err
+				}
+				statuses[context] = TaskRunStatus{Phase: phaseQueued}
+			}
+		}
+	}
+	return nil
+}
+
+// skipForNeed marks task as skipped because need, a task it needs, did not
+// succeed.
+func (b *Builder) skipForNeed(ctx context.Context, task TaskConfig, need string) error {
+	description := "skipped: " + need + " did not succeed"
+	if err := b.reportStatus(ctx, task, "success", description); err != nil {
+		return err
+	}
+	return b.updateTaskRuns(task, func(s *TaskRunStatus) {
+		s.setState("success", description, time.Time{}, time.Time{})
+		s.SkippedFor = need
+	})
+}
+
+// needPhase combines the statuses of every variant of the task named need
+// into Succeeded, Failed or Pending. It is Succeeded only when all of them
+// succeeded or were skipped by their filters, and Pending while any of them
+// has not finished. A variant that was skipped because of its own needs
+// counts as having failed, and one that doesn't run at this revision at all
+// doesn't hold anything up.
+func (b *Builder) needPhase(statuses map[string]TaskRunStatus, need string) string {
+	rv := phaseSucceeded
+	for _, task := range b.Config.allTasks() {
+		if task.Name != need {
+			continue
+		}
+		s, ok := statuses[b.statusContext(task)]
+		switch {
+		case !ok, s.Phase == phaseSucceeded, s.Phase == phaseSkipped && s.SkippedFor == "":
+		case s.Phase == phaseSkipped, s.Phase == phaseFailed, s.Phase == phaseError:
+			rv = phaseFailed
+		default:
+			return phasePending
+		}
+	}
+	return rv
+}
+
+// builderFromPod returns the Builder for the build that created pod, as
+// recorded in its Build. If the Build is gone, the configuration is fetched
+// again at the revision being built.
+func builderFromPod(ctx context.Context, pod *v1.Pod) (*Builder, error) {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	if name := annotations["triggr.crewjam.com/build"]; name != "" {
+		build, err := getBuild(name)
+		if err == nil {
+			return builderFromBuild(build), nil
+		}
+		if !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("cannot get build %s: %v", name, err)
+		}
+	}
+	owner := annotations["triggr.crewjam.com/github-owner"]
+	name := annotations["triggr.crewjam.com/github-repo"]
+	b := &Builder{
+		Repo: &github.Repository{
+			Name:     github.String(name),
+			FullName: github.String(owner + "/" + name),
+		},
+		Event:     annotations["triggr.crewjam.com/event"],
+		SHA:       annotations["triggr.crewjam.com/github-ref"],
+		Ref:       annotations["triggr.crewjam.com/git-ref"],
+		Owner:     owner,
+		Gist:      &github.Gist{ID: github.String(annotations["triggr.crewjam.com/output-gist"])},
+		TargetURL: annotations["triggr.crewjam.com/github-target-url"],
+	}
+	if only := annotations["triggr.crewjam.com/only"]; only != "" {
+		b.Only = strings.Split(only, ",")
+	}
+	b.Manual = annotations["triggr.crewjam.com/manual"] == "true"
+	b.Trusted = annotations["triggr.crewjam.com/trusted"] == "true"
+	if pr := pod.GetObjectMeta().GetLabels()["pr"]; pr != "" {
+		number, err := strconv.Atoi(pr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse pr label: %v", err)
+		}
+		b.PullRequest = &github.PullRequest{Number: github.Int(number)}
+	}
+	if err := b.getConfig(ctx); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// startDependents starts the tasks that were waiting for the task run by pod,
+// which has just finished.
+func startDependents(ctx context.Context, pod *v1.Pod) error {
+	b, err := builderFromPod(ctx, pod)
+	if err != nil {
+		return err
+	}
+	hasNeeds := false
+	for _, task := range b.Config.Tasks {
+		if len(task.Needs) > 0 {
+			hasNeeds = true
+		}
+	}
+	if !hasNeeds {
+		return nil
+	}
+	return b.startReady(ctx)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckNeeds(t *testing.T) {
+	task := func(name string, needs ...string) TaskConfig {
+		return TaskConfig{Name: name, Needs: needs}
+	}
+	tests := []struct {
+		name    string
+		tasks   []TaskConfig
+		wantErr bool
+	}{
+		{"no needs", []TaskConfig{task("lint"), task("test")}, false},
+		{"chain", []TaskConfig{task("deploy", "test"), task("test", "lint"), task("lint")}, false},
+		{"diamond", []TaskConfig{task("a"), task("b", "a"), task("c", "a"), task("d", "b", "c")}, false},
+		{"unknown task", []TaskConfig{task("test", "build")}, true},
+		{"itself", []TaskConfig{task("test", "test")}, true},
+		{"two tasks", []TaskConfig{task("a", "b"), task("b", "a")}, true},
+		{"three tasks", []TaskConfig{task("a", "c"), task("b", "a"), task("c", "b")}, true},
+		{"cycle after a good task", []TaskConfig{task("lint"), task("a", "lint", "b"), task("b", "a")}, true},
+	}
+	for _, tt := range tests {
+		c := &Config{Tasks: tt.tasks}
+		if err := c.checkNeeds(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkNeeds() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNeedPhase(t *testing.T) {
+	b := &Builder{
+		Event: "push",
+		Config: Config{
+			AllTasks: expandMatrix([]TaskConfig{
+				{Name: "lint"},
+				{Name: "test", Matrix: map[string][]string{"go": {"1.20", "1.21"}}},
+			}),
+		},
+	}
+	status := func(phase string) TaskRunStatus {
+		return TaskRunStatus{Phase: phase}
+	}
+	lint := b.statusContext(TaskConfig{Name: "lint"})
+	test120 := b.statusContext(TaskConfig{Name: "test", Variant: map[string]string{"go": "1.20"}})
+	test121 := b.statusContext(TaskConfig{Name: "test", Variant: map[string]string{"go": "1.21"}})
+	tests := []struct {
+		name     string
+		need     string
+		statuses map[string]TaskRunStatus
+		want     string
+	}{
+		{"succeeded", "lint", map[string]TaskRunStatus{lint: status(phaseSucceeded)}, phaseSucceeded},
+		{"failed", "lint", map[string]TaskRunStatus{lint: status(phaseFailed)}, phaseFailed},
+		{"errored", "lint", map[string]TaskRunStatus{lint: status(phaseError)}, phaseFailed},
+		{"running", "lint", map[string]TaskRunStatus{lint: status(phaseRunning)}, phasePending},
+		{"waiting", "lint", map[string]TaskRunStatus{lint: status(phaseWaiting)}, phasePending},
+		{"not started", "lint", map[string]TaskRunStatus{lint: status(phasePending)}, phasePending},
+		{"skipped by its filters", "lint",
+			map[string]TaskRunStatus{lint: status(phaseSkipped)}, phaseSucceeded},
+		{"skipped for its own needs", "lint",
+			map[string]TaskRunStatus{lint: {Phase: phaseSkipped, SkippedFor: "fmt"}}, phaseFailed},
+		{"not run at this revision", "lint", map[string]TaskRunStatus{}, phaseSucceeded},
+		{"all variants succeeded", "test",
+			map[string]TaskRunStatus{test120: status(phaseSucceeded), test121: status(phaseSucceeded)},
+			phaseSucceeded},
+		{"one variant failed", "test",
+			map[string]TaskRunStatus{test120: status(phaseFailed), test121: status(phaseSucceeded)},
+			phaseFailed},
+		{"one variant still running", "test",
+			map[string]TaskRunStatus{test120: status(phaseFailed), test121: status(phaseRunning)},
+			phasePending},
+	}
+	for _, tt := range tests {
+		if got := b.needPhase(tt.statuses, tt.need); got != tt.want {
+			t.Errorf("%s: needPhase(%s) = %s, want %s", tt.name, tt.need, got, tt.want)
+		}
+	}
+}
+
+func TestConfigAllTasks(t *testing.T) {
+	lint, test := TaskConfig{Name: "lint"}, TaskConfig{Name: "test"}
+	tests := []struct {
+		name   string
+		config Config
+		want   []TaskConfig
+	}{
+		{"all tasks known", Config{Tasks: []TaskConfig{test}, AllTasks: []TaskConfig{lint, test}},
+			[]TaskConfig{lint, test}},
+		{"recorded before all tasks were kept", Config{Tasks: []TaskConfig{test}},
+			[]TaskConfig{test}},
+	}
+	for _, tt := range tests {
+		if got := tt.config.allTasks(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: allTasks() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
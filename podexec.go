@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/remotecommand"
+)
+
+func helperImageName() string {
+	if *helperImage == "" {
+		return "busybox"
+	}
+	return *helperImage
+}
+
+// collector returns the container in pod that stays around after the task is
+// done, so that the controller can exec into it to copy things out of the
+// pod's volumes. The container is added if the pod doesn't have one yet.
+//
+// The returned pointer is only good until more containers are added.
+func collector(pod *v1.Pod) *v1.Container {
+	for i, container := range pod.Spec.Containers {
+		if container.Name == "collector" {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{
+		Name:    "collector",
+		Image:   helperImageName(),
+		Command: []string{"/bin/sh", "-c", "trap 'exit 0' TERM ; while true ; do sleep 1 ; done"},
+		VolumeMounts: []v1.VolumeMount{
+			{
+				Name:      "workspace",
+				MountPath: workspaceDir,
+			},
+		},
+	})
+	return &pod.Spec.Containers[len(pod.Spec.Containers)-1]
+}
+
+// execInPod runs command in the named container of pod, writing its output to
+// stdout. It is an error for the command to fail.
+func execInPod(pod *v1.Pod, container string, command []string, stdout io.Writer) error {
+	req := kubeClient.CoreV1().RESTClient().Post().
+		Namespace(pod.GetNamespace()).
+		Name(pod.GetName()).
+		Resource("pods").
+		SubResource("exec").
+		VersionedParams(&v1.PodExecOptions{
+			Container: container,
+			Command:   command,
+			Stdout:    true,
+			Stderr:    true,
+		}, scheme.ParameterCodec)
+	executor, err := remotecommand.NewSPDYExecutor(kubeConfig, "POST", req.URL())
+	if err != nil {
+		return fmt.Errorf("cannot exec in pod: %v", err)
+	}
+	stderr := bytes.NewBuffer(nil)
+	err = executor.Stream(remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", strings.Join(command, " "), err,
+			strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
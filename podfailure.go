@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+)
+
+// unschedulableTimeout is how long a task pod may wait for a node before it
+// is given up on. It is long enough for the cluster autoscaler to add one.
+const unschedulableTimeout = 5 * time.Minute
+
+// allContainerStatuses returns the statuses of the init containers of pod
+// followed by those of its other containers.
+func allContainerStatuses(pod *v1.Pod) []v1.ContainerStatus {
+	rv := append([]v1.ContainerStatus{}, pod.Status.InitContainerStatuses...)
+	return append(rv, pod.Status.ContainerStatuses...)
+}
+
+// containerSpec returns the container of pod called name, or nil if there
+// isn't one.
+func containerSpec(pod *v1.Pod, name string) *v1.Container {
+	for i := range pod.Spec.InitContainers {
+		if pod.Spec.InitContainers[i].Name == name {
+			return &pod.Spec.InitContainers[i]
+		}
+	}
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	return nil
+}
+
+// waitingFailure describes why a container of pod will never start, or
+// returns an empty string if they all might.
+func waitingFailure(pod *v1.Pod) string {
+	for _, containerStatus := range allContainerStatuses(pod) {
+		w := containerStatus.State.Waiting
+		if w == nil {
+			continue
+		}
+		image := containerStatus.Image
+		if container := containerSpec(pod, containerStatus.Name); container != nil {
+			image = container.Image
+		}
+		switch {
+		case isImagePullError(w.Reason):
+			for _, notFound := range []string{"not found", "manifest unknown", "does not exist"} {
+				if strings.Contains(w.Message, notFound) {
+					return "image " + image + " not found"
+				}
+			}
+			return "cannot pull image " + image
+		case w.Reason == "InvalidImageName":
+			return "invalid image name " + image
+		case w.Reason == "CrashLoopBackOff":
+			return containerStatus.Name + " keeps crashing"
+		case w.Reason == "CreateContainerConfigError", w.Reason == "CreateContainerError":
+			return "cannot create container " + containerStatus.Name + ": " + w.Message
+		}
+	}
+	return ""
+}
+
+// unschedulable returns why pod can't be scheduled and for how long that has
+// been so, or zero if it isn't unschedulable.
+func unschedulable(pod *v1.Pod) (string, time.Duration) {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodScheduled && condition.Status == v1.ConditionFalse &&
+			condition.Reason == v1.PodReasonUnschedulable {
+			return condition.Message, time.Since(condition.LastTransitionTime.Time)
+		}
+	}
+	return "", 0
+}
+
+// oomDescription describes the container called name in pod running out of
+// memory.
+func oomDescription(pod *v1.Pod, name string) string {
+	if container := containerSpec(pod, name); container != nil {
+		if limit, ok := container.Resources.Limits[v1.ResourceMemory]; ok {
+			return "OOMKilled (limit " + limit.String() + ")"
+		}
+	}
+	return "OOMKilled"
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestWaitingFailure(t *testing.T) {
+	tests := []struct {
+		reason  string
+		message string
+		want    string
+	}{
+		{"ContainerCreating", "", ""},
+		{"PodInitializing", "", ""},
+		{"ErrImagePull", "rpc error: manifest unknown", "image golang:nope not found"},
+		{"ImagePullBackOff", "Back-off pulling image", "cannot pull image golang:nope"},
+		{"InvalidImageName", "", "invalid image name golang:nope"},
+		{"CrashLoopBackOff", "", "exec keeps crashing"},
+		{"CreateContainerConfigError", "secret \"x\" not found", "cannot create container exec: secret \"x\" not found"},
+	}
+	for _, tt := range tests {
+		pod := &v1.Pod{
+			Spec: v1.PodSpec{Containers: []v1.Container{{Name: "exec", Image: "golang:nope"}}},
+			Status: v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+				Name:  "exec",
+				Image: "docker.io/library/golang:nope",
+				State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{
+					Reason:  tt.reason,
+					Message: tt.message,
+				}},
+			}}},
+		}
+		if got := waitingFailure(pod); got != tt.want {
+			t.Errorf("waitingFailure(%s) = %q, want %q", tt.reason, got, tt.want)
+		}
+	}
+}
+
+func TestUnschedulable(t *testing.T) {
+	condition := func(status v1.ConditionStatus, reason string) v1.PodCondition {
+		return v1.PodCondition{
+			Type:               v1.PodScheduled,
+			Status:             status,
+			Reason:             reason,
+			Message:            "0/3 nodes are available: 3 Insufficient cpu.",
+			LastTransitionTime: metav1.NewTime(time.Now().Add(-10 * time.Minute)),
+		}
+	}
+	tests := []struct {
+		name       string
+		conditions []v1.PodCondition
+		want       string
+	}{
+		{"scheduled", []v1.PodCondition{condition(v1.ConditionTrue, "")}, ""},
+		{"unschedulable", []v1.PodCondition{condition(v1.ConditionFalse, v1.PodReasonUnschedulable)},
+			"0/3 nodes are available: 3 Insufficient cpu."},
+		{"no conditions", nil, ""},
+	}
+	for _, tt := range tests {
+		pod := &v1.Pod{Status: v1.PodStatus{Conditions: tt.conditions}}
+		got, since := unschedulable(pod)
+		if got != tt.want {
+			t.Errorf("%s: unschedulable() = %q, want %q", tt.name, got, tt.want)
+		}
+		if (got != "") != (since > unschedulableTimeout) {
+			t.Errorf("%s: unschedulable() for %v", tt.name, since)
+		}
+	}
+}
+
+func TestOOMDescription(t *testing.T) {
+	pod := &v1.Pod{Spec: v1.PodSpec{
+		InitContainers: []v1.Container{{Name: "step-build", Resources: v1.ResourceRequirements{
+			Limits: v1.ResourceList{v1.ResourceMemory: resource.MustParse("4Gi")},
+		}}},
+		Containers: []v1.Container{{Name: "exec"}},
+	}}
+	tests := []struct {
+		container string
+		want      string
+	}{
+		{"step-build", "OOMKilled (limit 4Gi)"},
+		{"exec", "OOMKilled"},
+		{"missing", "OOMKilled"},
+	}
+	for _, tt := range tests {
+		if got := oomDescription(pod, tt.container); got != tt.want {
+			t.Errorf("oomDescription(%s) = %q, want %q", tt.container, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// buildQueue holds the tasks that are ready to run until there is room for
+// their pods under the limits set by -max-running, -max-running-per-repo and
+// -max-running-per-owner.
+var buildQueue = &BuildQueue{
+	running:   map[string]runningPod{},
+	wake:      make(chan struct{}, 1),
+	positions: make(chan struct{}, 1),
+}
+
+// positionInterval is the least time between updates of the positions of
+// queued tasks, so that a busy queue doesn't keep rewriting all their
+// statuses.
+const positionInterval = 10 * time.Second
+
+// queuedTask is a task waiting in the build queue.
+type queuedTask struct {
+	Builder  *Builder
+	Task     TaskConfig
+	Pod      *v1.Pod // the next attempt of a task being retried, or nil
+	Position int     // the position last reported in the task's status
+}
+
+// podName returns the name of the pod that runs item.
+func (item *queuedTask) podName() string {
+	if item.Pod != nil {
+		return item.Pod.GetName()
+	}
+	return item.Builder.podName(item.Task)
+}
+
+// runningPod is a task pod that counts against the limits.
+type runningPod struct {
+	Owner string
+	Repo  string
+}
+
+// BuildQueue starts tasks in a fair order while keeping the number of task
+// pods under the configured limits.
+//
+// Tasks are queued per repository, and the repositories take turns. Pushes to
+// the push branches go ahead of everything else.
+type BuildQueue struct {
+	MaxRunning         int // zero means no limit
+	MaxRunningPerRepo  int
+	MaxRunningPerOwner int
+
+	mu      sync.Mutex
+	tiers   [2]queueTier
+	running map[string]runningPod // keyed by namespace/name
+
+	// statusMu is held while a queued task's position is written to its
+	// status, and while tasks are taken out of the queue, so that the
+	// position never overwrites the status of a task that has just started
+	// or been cancelled. It is taken before mu.
+	statusMu sync.Mutex
+
+	wake      chan struct{} // signals Run to dispatch
+	positions chan struct{} // signals reportPositions to run
+}
+
+// queueTier holds the queued tasks of one priority.
+type queueTier struct {
+	repos []string                 // repositories in the order they take turns
+	next  int                      // the index in repos of the next one
+	tasks map[string][]*queuedTask // keyed by repository full name
+}
+
+// parseQueueLimits sets the limits of buildQueue from the command line.
+func parseQueueLimits() error {
+	for _, l := range []struct {
+		Name  string
+		Value string
+		Limit *int
+	}{
+		{"max-running", *maxRunning, &buildQueue.MaxRunning},
+		{"max-running-per-repo", *maxRunningPerRepo, &buildQueue.MaxRunningPerRepo},
+		{"max-running-per-owner", *maxRunningPerOwner, &buildQueue.MaxRunningPerOwner},
+	} {
+		if l.Value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(l.Value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid -%s %q", l.Name, l.Value)
+		}
+		*l.Limit = n
+	}
+	return nil
+}
+
+// priority returns the tier that the tasks of b are queued in. Pushes to the
+// branches that are built on push, master unless configured otherwise, go
+// first.
+func (b *Builder) priority() int {
+	if b.Event == "push" && b.branch() != "" && matchAny(b.pushBranches(), b.branch()) {
+		return 0
+	}
+	return 1
+}
+
+// Add queues task, which Run starts as soon as there is room for it. If task
+// has to wait, its status says where it is in the queue.
+func (q *BuildQueue) Add(b *Builder, task TaskConfig) {
+	q.add(&queuedTask{Builder: b, Task: task})
+}
+
+// AddRetry queues pod, the next attempt at task, in the same way as Add.
+func (q *BuildQueue) AddRetry(b *Builder, task TaskConfig, pod *v1.Pod) {
+	q.add(&queuedTask{Builder: b, Task: task, Pod: pod})
+}
+
+func (q *BuildQueue) add(item *queuedTask) {
+	q.mu.Lock()
+	if q.has(item.podName()) {
+		// the task's needs can finish at about the same time and each
+		// try to start it
+		q.mu.Unlock()
+		return
+	}
+	t := &q.tiers[item.Builder.priority()]
+	repo := item.Builder.Repo.GetFullName()
+	if t.tasks == nil {
+		t.tasks = map[string][]*queuedTask{}
+	}
+	if len(t.tasks[repo]) == 0 {
+		t.repos = append(t.repos, repo)
+	}
+	t.tasks[repo] = append(t.tasks[repo], item)
+	q.mu.Unlock()
+
+	q.signal(q.wake)
+}
+
+// signal wakes up whatever waits on ch, unless it is already due to wake up.
+func (q *BuildQueue) signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Run starts queued tasks whenever there may be room for them, until ctx is
+// done. The tasks are started in ctx rather than in the context of whatever
+// queued them, since they may belong to other builds.
+func (q *BuildQueue) Run(ctx context.Context) {
+	go q.reportPositions(ctx)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+			q.dispatch(ctx)
+			q.signal(q.positions)
+		}
+	}
+}
+
+// Remove takes the queued tasks for which match returns true out of the
+// queue, and returns them.
+func (q *BuildQueue) Remove(match func(b *Builder, task TaskConfig) bool) []*queuedTask {
+	q.statusMu.Lock()
+	defer q.statusMu.Unlock()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.signal(q.positions)
+	rv := []*queuedTask{}
+	for i := range q.tiers {
+		t := &q.tiers[i]
+		for _, repo := range append([]string{}, t.repos...) {
+			kept := []*queuedTask{}
+			for _, item := range t.tasks[repo] {
+				if match(item.Builder, item.Task) {
+					rv = append(rv, item)
+				} else {
+					kept = append(kept, item)
+				}
+			}
+			t.tasks[repo] = kept
+			if len(kept) == 0 {
+				t.removeRepo(repo)
+			}
+		}
+	}
+	return rv
+}
+
+// PodStarted counts pod against the limits. The controller calls it for
+// every task pod it sees, including the ones that were running before the
+// server started. The pods of a Job are counted by way of the Job.
+func (q *BuildQueue) PodStarted(pod *v1.Pod) {
+	if pod.GetObjectMeta().GetLabels()["job-name"] != "" {
+		return
+	}
+	q.started(pod.GetObjectMeta())
+}
+
+// JobStarted counts job against the limits until it finishes.
+func (q *BuildQueue) JobStarted(job *batchv1.Job) {
+	if jobFinished(job) {
+		return
+	}
+	q.started(job.GetObjectMeta())
+}
+
+func (q *BuildQueue) started(obj metav1.Object) {
+	labels := obj.GetLabels()
+	if labels["triggr"] != "true" {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.running[obj.GetNamespace()+"/"+obj.GetName()] = runningPod{
+		Owner: labels["owner"],
+		Repo:  labels["owner"] + "/" + labels["repo"],
+	}
+}
+
+// PodStopped stops counting the pod or job named by key, which has been
+// deleted or has finished, and starts whatever can now be started.
+func (q *BuildQueue) PodStopped(key string) {
+	q.mu.Lock()
+	_, ok := q.running[key]
+	delete(q.running, key)
+	q.mu.Unlock()
+
+	if ok {
+		q.signal(q.wake)
+	}
+}
+
+// dispatch starts queued tasks until the queue is empty or the limits are
+// reached.
+func (q *BuildQueue) dispatch(ctx context.Context) {
+	for {
+		q.statusMu.Lock()
+		q.mu.Lock()
+		item := q.next()
+		if item != nil {
+			// count the pod straight away so that the next task sees it
+			q.running[*kubeNamespace+"/"+item.podName()] = runningPod{
+				Owner: item.Builder.Owner,
+				Repo:  item.Builder.Repo.GetFullName(),
+			}
+		}
+		q.mu.Unlock()
+		q.statusMu.Unlock()
+		if item == nil {
+			break
+		}
+
+		var started bool
+		var err error
+		if item.Pod != nil {
+			started, err = item.Builder.runRetry(ctx, item.Task, item.Pod)
+		} else {
+			started, err = item.Builder.runQueuedTask(ctx, item.Task)
+		}
+		if err != nil {
+			log.Printf("%s: cannot start %s: %v", item.Builder.Repo.GetFullName(), item.Task.ID(), err)
+		}
+		if !started {
+			q.mu.Lock()
+			delete(q.running, *kubeNamespace+"/"+item.podName())
+			q.mu.Unlock()
+		}
+	}
+}
+
+// reportPositions updates the position in the status of each task that is
+// still waiting whenever the queue has changed, at most once every
+// positionInterval. Only the tasks whose position has changed are updated,
+// and only while they are still queued.
+func (q *BuildQueue) reportPositions(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.positions:
+		}
+
+		q.mu.Lock()
+		moved := []*queuedTask{}
+		descriptions := []string{}
+		for i, item := range q.order() {
+			if item.Position != i+1 {
+				item.Position = i + 1
+				moved = append(moved, item)
+				descriptions = append(descriptions, fmt.Sprintf("queued (position %d)", item.Position))
+			}
+		}
+		q.mu.Unlock()
+
+		for i, item := range moved {
+			q.statusMu.Lock()
+			q.mu.Lock()
+			queued := q.queued(item)
+			q.mu.Unlock()
+			if queued {
+				if err := item.Builder.setStatus(ctx, item.Task, "pending", descriptions[i]); err != nil {
+					log.Printf("%s: %v", item.Builder.Repo.GetFullName(), err)
+				}
+			}
+			q.statusMu.Unlock()
+		}
+		time.Sleep(positionInterval)
+	}
+}
+
+// next takes the next task that may start out of the queue, or returns nil if
+// there isn't one. The caller must hold q.mu.
+func (q *BuildQueue) next() *queuedTask {
+	if q.MaxRunning > 0 && len(q.running) >= q.MaxRunning {
+		return nil
+	}
+	repoCount := map[string]int{}
+	ownerCount := map[string]int{}
+	for _, pod := range q.running {
+		repoCount[pod.Repo]++
+		ownerCount[pod.Owner]++
+	}
+
+	for i := range q.tiers {
+		t := &q.tiers[i]
+		for j := 0; j < len(t.repos); j++ {
+			index := (t.next + j) % len(t.repos)
+			repo := t.repos[index]
+			item := t.tasks[repo][0]
+			if q.MaxRunningPerRepo > 0 && repoCount[repo] >= q.MaxRunningPerRepo {
+				continue
+			}
+			if q.MaxRunningPerOwner > 0 && ownerCount[item.Builder.Owner] >= q.MaxRunningPerOwner {
+				continue
+			}
+
+			t.tasks[repo] = t.tasks[repo][1:]
+			t.next = index + 1
+			if len(t.tasks[repo]) == 0 {
+				t.removeRepo(repo)
+			}
+			if len(t.repos) > 0 {
+				t.next %= len(t.repos)
+			}
+			return item
+		}
+	}
+	return nil
+}
+
+// queued returns true if item is still in the queue. The caller must hold
+// q.mu.
+func (q *BuildQueue) queued(item *queuedTask) bool {
+	for _, queued := range q.tiers[item.Builder.priority()].tasks[item.Builder.Repo.GetFullName()] {
+		if queued == item {
+			return true
+		}
+	}
+	return false
+}
+
+// has returns true if the pod named podName is queued or running. The caller
+// must hold q.mu.
+func (q *BuildQueue) has(podName string) bool {
+	if _, ok := q.running[*kubeNamespace+"/"+podName]; ok {
+		return true
+	}
+	for _, item := range q.order() {
+		if item.podName() == podName {
+			return true
+		}
+	}
+	return false
+}
+
+// order returns the queued tasks in the order they would start if there
+// were no per-repository or per-owner limits. The caller must hold q.mu.
+func (q *BuildQueue) order() []*queuedTask {
+	rv := []*queuedTask{}
+	for i := range q.tiers {
+		t := &q.tiers[i]
+		for depth := 0; ; depth++ {
+			found := false
+			for j := range t.repos {
+				repo := t.repos[(t.next+j)%len(t.repos)]
+				if depth < len(t.tasks[repo]) {
+					rv = append(rv, t.tasks[repo][depth])
+					found = true
+				}
+			}
+			if !found {
+				break
+			}
+		}
+	}
+	return rv
+}
+
+// removeRepo takes repo out of the turn order, keeping the turn with the
+// repository that has it now.
+func (t *queueTier) removeRepo(repo string) {
+	for i, r := range t.repos {
+		if r != repo {
+			continue
+		}
+		t.repos = append(t.repos[:i], t.repos[i+1:]...)
+		delete(t.tasks, repo)
+		if i < t.next {
+			t.next--
+		}
+		if t.next >= len(t.repos) {
+			t.next = 0
+		}
+		return
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+)
+
+func TestBuildQueueNext(t *testing.T) {
+	// each task is "owner/repo task", or "owner/repo task push" for a push
+	// to master
+	tests := []struct {
+		name    string
+		limits  [3]int // MaxRunning, MaxRunningPerRepo, MaxRunningPerOwner
+		running []runningPod
+		tasks   []string
+		want    []string
+	}{
+		{
+			name:  "one repo",
+			tasks: []string{"a/x 1", "a/x 2", "a/x 3"},
+			want:  []string{"a/x 1", "a/x 2", "a/x 3"},
+		},
+		{
+			name:  "repos take turns",
+			tasks: []string{"a/x 1", "a/x 2", "a/x 3", "b/y 1", "c/z 1", "c/z 2"},
+			want:  []string{"a/x 1", "b/y 1", "c/z 1", "a/x 2", "c/z 2", "a/x 3"},
+		},
+		{
+			name:  "pushes go first",
+			tasks: []string{"a/x 1", "b/y 1", "c/z 1 push", "c/z 2"},
+			want:  []string{"c/z 1 push", "a/x 1", "b/y 1", "c/z 2"},
+		},
+		{
+			name:    "max running",
+			limits:  [3]int{2, 0, 0},
+			running: []runningPod{{Owner: "a", Repo: "a/x"}},
+			tasks:   []string{"b/y 1", "b/y 2"},
+			want:    []string{"b/y 1"},
+		},
+		{
+			name:    "max running reached",
+			limits:  [3]int{1, 0, 0},
+			running: []runningPod{{Owner: "a", Repo: "a/x"}},
+			tasks:   []string{"b/y 1"},
+			want:    nil,
+		},
+		{
+			name:    "max running per repo",
+			limits:  [3]int{0, 1, 0},
+			running: []runningPod{{Owner: "a", Repo: "a/x"}},
+			tasks:   []string{"a/x 1", "a/w 1", "a/x 2", "a/w 2", "b/y 1"},
+			want:    []string{"a/w 1", "b/y 1"},
+		},
+		{
+			name:    "max running per owner",
+			limits:  [3]int{0, 0, 2},
+			running: []runningPod{{Owner: "a", Repo: "a/x"}, {Owner: "a", Repo: "a/w"}},
+			tasks:   []string{"a/x 1", "b/y 1", "a/w 1", "b/y 2"},
+			want:    []string{"b/y 1", "b/y 2"},
+		},
+		{
+			name:    "blocked push",
+			limits:  [3]int{0, 1, 0},
+			running: []runningPod{{Owner: "c", Repo: "c/z"}},
+			tasks:   []string{"a/x 1", "c/z 1 push"},
+			want:    []string{"a/x 1"},
+		},
+	}
+	for _, tt := range tests {
+		q := &BuildQueue{
+			MaxRunning:         tt.limits[0],
+			MaxRunningPerRepo:  tt.limits[1],
+			MaxRunningPerOwner: tt.limits[2],
+			running:            map[string]runningPod{},
+		}
+		for i, pod := range tt.running {
+			q.running[fmt.Sprintf("running-%d", i)] = pod
+		}
+		for _, task := range tt.tasks {
+			q.Add(queueTestBuilder(task), TaskConfig{Name: task})
+		}
+
+		// count each task as it starts, as dispatch does
+		var got []string
+		for item := q.next(); item != nil; item = q.next() {
+			got = append(got, item.Task.Name)
+			q.running[item.Task.Name] = runningPod{
+				Owner: item.Builder.Owner,
+				Repo:  item.Builder.Repo.GetFullName(),
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: started %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildQueueAdd(t *testing.T) {
+	// each task is "owner/repo task", as for TestBuildQueueNext
+	tests := []struct {
+		name    string
+		running []string
+		tasks   []string
+		want    []string
+	}{
+		{
+			name:  "distinct tasks",
+			tasks: []string{"a/x 1", "a/x 2", "b/y 1"},
+			want:  []string{"a/x 1", "b/y 1", "a/x 2"},
+		},
+		{
+			name:  "same task twice",
+			tasks: []string{"a/x 1", "a/x 2", "a/x 1"},
+			want:  []string{"a/x 1", "a/x 2"},
+		},
+		{
+			name:    "task already running",
+			running: []string{"a/x 1"},
+			tasks:   []string{"a/x 1", "a/x 2"},
+			want:    []string{"a/x 2"},
+		},
+	}
+	for _, tt := range tests {
+		q := &BuildQueue{running: map[string]runningPod{}}
+		for _, task := range tt.running {
+			name := queueTestBuilder(task).podName(TaskConfig{Name: task})
+			q.running[*kubeNamespace+"/"+name] = runningPod{}
+		}
+		for _, task := range tt.tasks {
+			q.Add(queueTestBuilder(task), TaskConfig{Name: task})
+		}
+
+		var got []string
+		for _, item := range q.order() {
+			got = append(got, item.Task.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: queued %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestBuildQueueQueued(t *testing.T) {
+	q := &BuildQueue{running: map[string]runningPod{}}
+	q.Add(queueTestBuilder("a/x 1"), TaskConfig{Name: "a/x 1"})
+	q.Add(queueTestBuilder("a/x 2 push"), TaskConfig{Name: "a/x 2 push"})
+	items := q.order()
+
+	started := q.next()
+	for _, item := range items {
+		if got, want := q.queued(item), item != started; got != want {
+			t.Errorf("queued(%s) = %v, want %v", item.Task.Name, got, want)
+		}
+	}
+	q.Remove(func(b *Builder, task TaskConfig) bool { return true })
+	for _, item := range items {
+		if q.queued(item) {
+			t.Errorf("queued(%s) = true after Remove, want false", item.Task.Name)
+		}
+	}
+}
+
+// queueTestBuilder returns a Builder for a task of the build queue tests.
+func queueTestBuilder(task string) *Builder {
+	fields := strings.Fields(task)
+	parts := strings.SplitN(fields[0], "/", 2)
+	b := &Builder{
+		Owner: parts[0],
+		Repo: &github.Repository{
+			Name:     github.String(parts[1]),
+			FullName: github.String(fields[0]),
+		},
+		SHA:   "0123456789abcdef0123456789abcdef01234567",
+		Event: "pull-request",
+		Config: Config{
+			PushBranches: []string{"master"},
+		},
+	}
+	if len(fields) > 2 && fields[2] == "push" {
+		b.Event = "push"
+		b.Ref = "refs/heads/master"
+	}
+	return b
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+)
+
+// maxBuildAge is how long a build is kept track of. Tasks that still haven't
+// finished after this long are given up on.
+const maxBuildAge = 7 * 24 * time.Hour
+
+// reconcileBuilds brings the builds that were in progress when the server
+// stopped up to date. The pods that still exist are taken care of by the
+// controller as it lists them. This takes care of the TaskRuns that have no
+// pod, because they were queued or about to start when the server stopped,
+// or because their pod was deleted while it was down. It also revokes the
+// broker tokens of pods that are gone.
+func (c *Controller) reconcileBuilds() {
+	ctx := context.Background()
+	if err := revokeOrphanedTokens(c.brokerSecretsInUse()); err != nil {
+		log.Printf("reconcileBuilds: %v", err)
+	}
+	if !crdsInstalled {
+		return
+	}
+
+	builds, err := listBuilds("phase=" + phaseRunning)
+	if err != nil {
+		log.Printf("reconcileBuilds: cannot list builds: %v", err)
+		return
+	}
+
+	// the same task may be in more than one build, e.g. if it was retested
+	started := map[string]bool{}
+	for i := range builds.Items {
+		build := &builds.Items[i]
+		if build.Status.Phase != phaseRunning {
+			continue
+		}
+		if err := c.reconcileBuild(ctx, build, started); err != nil {
+			log.Printf("reconcileBuilds: %s: %v", build.GetName(), err)
+		}
+	}
+}
+
+// reconcileBuild reconciles the TaskRuns of build. Tasks whose pods hadn't
+// been created yet are queued again, and tasks whose pods have gone are
+// marked as errored. started records the tasks that have been queued again, keyed
+// by revision and status context.
+func (c *Controller) reconcileBuild(ctx context.Context, build *Build, started map[string]bool) error {
+	taskRuns, err := listTaskRuns("build=" + build.GetName())
+	if err != nil {
+		return err
+	}
+	if time.Since(build.CreationTimestamp.Time) > maxBuildAge {
+		for _, taskRun := range taskRuns.Items {
+			if finishedPhase(taskRun.Status.Phase) {
+				continue
+			}
+			err := updateTaskRunStatus(taskRun.GetName(), func(s *TaskRunStatus) {
+				s.setState("error", "given up on after a week", time.Time{}, time.Time{})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return finishBuild(build.GetName())
+	}
+
+	b := builderFromBuild(build)
+	byTask := map[string]*TaskRun{}
+	for i := range taskRuns.Items {
+		byTask[taskRuns.Items[i].Spec.Task] = &taskRuns.Items[i]
+	}
+	hasPod := map[string]bool{}
+	for _, obj := range c.indexer.List() {
+		hasPod[obj.(*v1.Pod).GetObjectMeta().GetAnnotations()["triggr.crewjam.com/task-run"]] = true
+	}
+	if c.jobIndexer != nil {
+		for _, obj := range c.jobIndexer.List() {
+			hasPod[obj.(*batchv1.Job).GetAnnotations()["triggr.crewjam.com/task-run"]] = true
+		}
+	}
+
+	pending, waiting := false, false
+	for _, task := range b.Config.Tasks {
+		taskRun := byTask[task.ID()]
+		if taskRun == nil || finishedPhase(taskRun.Status.Phase) {
+			continue
+		}
+		pending = true
+		key := b.SHA + " " + b.statusContext(task)
+		switch s := taskRun.Status; {
+		case hasPod[taskRun.GetName()], started[key]:
+			// the controller is taking care of it
+		case s.Phase == phasePending:
+			// the server stopped before the build got to this task
+			switch reason := b.skipReason(task); {
+			case reason != "":
+				err = b.setStatus(ctx, task, "success", "skipped: "+reason)
+			case len(task.Needs) > 0:
+				waiting = true
+				err = b.waitTask(ctx, task)
+			default:
+				started[key] = true
+				err = b.startTask(ctx, task)
+			}
+			if err != nil {
+				return err
+			}
+		case s.Phase == phaseWaiting:
+			waiting = true
+		case s.Phase == phaseAwaitingApproval:
+		case !s.Created:
+			// the task was queued, or about to start, or waiting to be
+			// retried
+			log.Printf("%s: %s: queueing %s again", b.Repo.GetFullName(), b.SHA, task.ID())
+			started[key] = true
+			if err := b.startTask(ctx, task); err != nil {
+				return err
+			}
+		default:
+			log.Printf("%s: %s: %s has no pod", b.Repo.GetFullName(), b.SHA, task.ID())
+			if err := b.setStatus(ctx, task, "error", "task pod was lost while triggr was not running"); err != nil {
+				return err
+			}
+		}
+	}
+	if waiting {
+		if err := b.startReady(ctx); err != nil {
+			return err
+		}
+	}
+	if !pending {
+		return finishBuild(build.GetName())
+	}
+	return nil
+}
+
+// brokerSecretsInUse returns the names of the broker secrets that the task
+// pods and Jobs the controller knows of refer to.
+func (c *Controller) brokerSecretsInUse() map[string]bool {
+	rv := map[string]bool{}
+	for _, obj := range c.indexer.List() {
+		rv[obj.(*v1.Pod).GetObjectMeta().GetAnnotations()["triggr.crewjam.com/broker-secret"]] = true
+	}
+	if c.jobIndexer != nil {
+		for _, obj := range c.jobIndexer.List() {
+			rv[obj.(*batchv1.Job).GetAnnotations()["triggr.crewjam.com/broker-secret"]] = true
+		}
+	}
+	return rv
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestBrokerSecretsInUse(t *testing.T) {
+	meta := func(name, secret string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: "ci", Annotations: map[string]string{
+			"triggr.crewjam.com/broker-secret": secret,
+		}}
+	}
+	pods := []*v1.Pod{
+		{ObjectMeta: meta("triggr-lint", "triggr-broker-1")},
+		{ObjectMeta: meta("triggr-test", "triggr-broker-2")},
+	}
+	jobs := []*batchv1.Job{
+		{ObjectMeta: meta("triggr-build", "triggr-broker-3")},
+	}
+	tests := []struct {
+		name string
+		jobs bool
+		want map[string]bool
+	}{
+		{"pods", false, map[string]bool{"triggr-broker-1": true, "triggr-broker-2": true}},
+		{"jobs", true, map[string]bool{"triggr-broker-1": true, "triggr-broker-2": true, "triggr-broker-3": true}},
+	}
+	for _, tt := range tests {
+		c := NewController(nil, cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}), nil)
+		for _, pod := range pods {
+			c.indexer.Add(pod)
+		}
+		if tt.jobs {
+			c.jobIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for _, job := range jobs {
+				c.jobIndexer.Add(job)
+			}
+		}
+		if got := c.brokerSecretsInUse(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: brokerSecretsInUse() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
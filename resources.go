@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+type TolerationConfig struct {
+	Key      string
+	Operator string
+	Value    string
+	Effect   string
+}
+
+// maxResources returns the maximums set by -max-cpu, -max-memory and
+// -max-ephemeral-storage.
+func maxResources() (v1.ResourceList, error) {
+	rv := v1.ResourceList{}
+	for _, r := range []struct {
+		Name v1.ResourceName
+		Max  string
+	}{
+		{v1.ResourceCPU, *maxCPU},
+		{v1.ResourceMemory, *maxMemory},
+		{v1.ResourceEphemeralStorage, *maxEphemeralStorage},
+	} {
+		if r.Max == "" {
+			continue
+		}
+		max, err := resource.ParseQuantity(r.Max)
+		if err != nil {
+			return rv, fmt.Errorf("invalid maximum %s %q: %v", r.Name, r.Max, err)
+		}
+		rv[r.Name] = max
+	}
+	return rv, nil
+}
+
+// taskResources returns the resources requested by task. The same values
+// are used for the requests and the limits. It is an error for a task to ask
+// for more than the maximums set by -max-cpu, -max-memory and
+// -max-ephemeral-storage.
+func taskResources(task TaskConfig) (v1.ResourceRequirements, error) {
+	rv := v1.ResourceRequirements{
+		Requests: v1.ResourceList{},
+		Limits:   v1.ResourceList{},
+	}
+	maxima, err := maxResources()
+	if err != nil {
+		return rv, err
+	}
+	for _, r := range []struct {
+		Name  v1.ResourceName
+		Value string
+	}{
+		{v1.ResourceCPU, task.CPU},
+		{v1.ResourceMemory, task.Memory},
+		{v1.ResourceEphemeralStorage, task.EphemeralStorage},
+	} {
+		if r.Value == "" {
+			continue
+		}
+		value, err := resource.ParseQuantity(r.Value)
+		if err != nil {
+			return rv, fmt.Errorf("invalid %s %q: %v", r.Name, r.Value, err)
+		}
+		if max, ok := maxima[r.Name]; ok && value.Cmp(max) > 0 {
+			return rv, fmt.Errorf("task requests %s %s, more than the maximum of %s",
+				r.Name, r.Value, max.String())
+		}
+		rv.Requests[r.Name] = value
+		rv.Limits[r.Name] = value
+	}
+	return rv, nil
+}
+
+// limitResources caps every container of pod, including the init, service
+// and helper containers, at the maximums set by -max-cpu, -max-memory and
+// -max-ephemeral-storage. A container with no limit gets the maximum as its
+// limit and, so that kubernetes doesn't default the request to the limit, a
+// request of zero.
+func limitResources(pod *v1.Pod) error {
+	maxima, err := maxResources()
+	if err != nil {
+		return err
+	}
+	limit := func(container *v1.Container) {
+		for name, max := range maxima {
+			if container.Resources.Limits == nil {
+				container.Resources.Limits = v1.ResourceList{}
+			}
+			if container.Resources.Requests == nil {
+				container.Resources.Requests = v1.ResourceList{}
+			}
+			if value, ok := container.Resources.Limits[name]; !ok || value.Cmp(max) > 0 {
+				container.Resources.Limits[name] = max.DeepCopy()
+			}
+			value, ok := container.Resources.Requests[name]
+			switch {
+			case !ok:
+				container.Resources.Requests[name] = resource.Quantity{Format: max.Format}
+			case value.Cmp(max) > 0:
+				container.Resources.Requests[name] = max.DeepCopy()
+			}
+		}
+	}
+	for i := range pod.Spec.InitContainers {
+		limit(&pod.Spec.InitContainers[i])
+	}
+	for i := range pod.Spec.Containers {
+		limit(&pod.Spec.Containers[i])
+	}
+	return nil
+}
+
+// taskTolerations returns the tolerations of the pod for task.
+func taskTolerations(task TaskConfig) []v1.Toleration {
+	rv := []v1.Toleration{}
+	for _, t := range task.Tolerations {
+		rv = append(rv, v1.Toleration{
+			Key:      t.Key,
+			Operator: v1.TolerationOperator(t.Operator),
+			Value:    t.Value,
+			Effect:   v1.TaintEffect(t.Effect),
+		})
+	}
+	return rv
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+func setMaxResources(t *testing.T, cpu, memory, storage string) {
+	oldCPU, oldMemory, oldStorage := *maxCPU, *maxMemory, *maxEphemeralStorage
+	*maxCPU, *maxMemory, *maxEphemeralStorage = cpu, memory, storage
+	t.Cleanup(func() {
+		*maxCPU, *maxMemory, *maxEphemeralStorage = oldCPU, oldMemory, oldStorage
+	})
+}
+
+func TestTaskResources(t *testing.T) {
+	setMaxResources(t, "4", "8Gi", "")
+	tests := []struct {
+		name    string
+		task    TaskConfig
+		want    v1.ResourceList
+		wantErr bool
+	}{
+		{"none", TaskConfig{}, v1.ResourceList{}, false},
+		{"all", TaskConfig{CPU: "2", Memory: "4Gi", EphemeralStorage: "100Gi"}, v1.ResourceList{
+			v1.ResourceCPU:              resource.MustParse("2"),
+			v1.ResourceMemory:           resource.MustParse("4Gi"),
+			v1.ResourceEphemeralStorage: resource.MustParse("100Gi"),
+		}, false},
+		{"at the maximum", TaskConfig{CPU: "4000m"}, v1.ResourceList{
+			v1.ResourceCPU: resource.MustParse("4"),
+		}, false},
+		{"over the maximum", TaskConfig{Memory: "9Gi"}, nil, true},
+		{"invalid", TaskConfig{CPU: "lots"}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := taskResources(tt.task)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: taskResources() error = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		for _, list := range []v1.ResourceList{got.Requests, got.Limits} {
+			if len(list) != len(tt.want) {
+				t.Errorf("%s: got %v, want %v", tt.name, list, tt.want)
+			}
+			for name, want := range tt.want {
+				if value := list[name]; value.Cmp(want) != 0 {
+					t.Errorf("%s: got %s %s, want %s", tt.name, name, value.String(), want.String())
+				}
+			}
+		}
+	}
+}
+
+func TestLimitResources(t *testing.T) {
+	setMaxResources(t, "4", "8Gi", "")
+	resources := func(request, limit string) v1.ResourceRequirements {
+		rv := v1.ResourceRequirements{}
+		if request != "" {
+			rv.Requests = v1.ResourceList{v1.ResourceCPU: resource.MustParse(request)}
+		}
+		if limit != "" {
+			rv.Limits = v1.ResourceList{v1.ResourceCPU: resource.MustParse(limit)}
+		}
+		return rv
+	}
+	tests := []struct {
+		name        string
+		resources   v1.ResourceRequirements
+		wantRequest string
+		wantLimit   string
+	}{
+		{"unset", resources("", ""), "0", "4"},
+		{"under the maximum", resources("1", "2"), "1", "2"},
+		{"limit over the maximum", resources("1", "16"), "1", "4"},
+		{"both over the maximum", resources("8", "16"), "4", "4"},
+		{"request only", resources("1", ""), "1", "4"},
+	}
+	for _, tt := range tests {
+		pod := &v1.Pod{Spec: v1.PodSpec{
+			InitContainers: []v1.Container{{Name: "checkout", Resources: *tt.resources.DeepCopy()}},
+			Containers:     []v1.Container{{Name: "exec", Resources: *tt.resources.DeepCopy()}},
+		}}
+		if err := limitResources(pod); err != nil {
+			t.Fatalf("%s: limitResources() = %v", tt.name, err)
+		}
+		for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			request := container.Resources.Requests[v1.ResourceCPU]
+			limit := container.Resources.Limits[v1.ResourceCPU]
+			if request.Cmp(resource.MustParse(tt.wantRequest)) != 0 {
+				t.Errorf("%s: %s requests %s cpu, want %s", tt.name, container.Name, request.String(), tt.wantRequest)
+			}
+			if limit.Cmp(resource.MustParse(tt.wantLimit)) != 0 {
+				t.Errorf("%s: %s is limited to %s cpu, want %s", tt.name, container.Name, limit.String(), tt.wantLimit)
+			}
+			memory := container.Resources.Limits[v1.ResourceMemory]
+			if memory.Cmp(resource.MustParse("8Gi")) != 0 {
+				t.Errorf("%s: %s is limited to %s memory, want 8Gi", tt.name, container.Name, memory.String())
+			}
+			if _, ok := container.Resources.Limits[v1.ResourceEphemeralStorage]; ok {
+				t.Errorf("%s: %s has an ephemeral storage limit with no maximum", tt.name, container.Name)
+			}
+		}
+	}
+
+	setMaxResources(t, "lots", "", "")
+	if err := limitResources(&v1.Pod{}); err == nil {
+		t.Errorf("limitResources() with an invalid maximum succeeded")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// defaultRetryOn lists the kinds of failure that are retried when a task
+// sets retries but not retry-on. These are the ones that are not the task's
+// fault.
+var defaultRetryOn = []string{"evicted", "image-pull"}
+
+func isImagePullError(reason string) bool {
+	return reason == "ErrImagePull" || reason == "ImagePullBackOff"
+}
+
+// failureKind returns the kind of failure that ended pod, as named in the
+// retry-on setting, or an empty string if it is not one of those.
+func failureKind(pod *v1.Pod) string {
+	if pod.Status.Reason == "Evicted" {
+		return "evicted"
+	}
+	for _, containerStatus := range allContainerStatuses(pod) {
+		if w := containerStatus.State.Waiting; w != nil && isImagePullError(w.Reason) {
+			return "image-pull"
+		}
+	}
+	for _, containerStatus := range pod.Status.InitContainerStatuses {
+		t := containerStatus.State.Terminated
+		if t != nil && t.ExitCode != 0 && containerStep(pod, containerStatus.Name) != "" {
+			if t.Reason == "OOMKilled" {
+				return "oom"
+			}
+			return "failure"
+		}
+	}
+	if containerStatus := execStatus(pod); containerStatus != nil {
+		if t := containerStatus.State.Terminated; t != nil {
+			switch t.Reason {
+			case "OOMKilled":
+				return "oom"
+			case "Error":
+				return "failure"
+			}
+		}
+	}
+	return ""
+}
+
+func podAttempt(pod *v1.Pod) int {
+	attempt, err := strconv.Atoi(pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/attempt"])
+	if err != nil {
+		return 1
+	}
+	return attempt
+}
+
+// attemptCount returns the number of times the task run by pod may be
+// attempted in total.
+func attemptCount(pod *v1.Pod) string {
+	retries, _ := strconv.Atoi(pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/retries"])
+	return strconv.Itoa(retries + 1)
+}
+
+// nextAttempt returns the pod for the next attempt at the task run by pod,
+// which has just ended, if the task asked to be retried for the way it
+// failed, or nil if it should not be retried. The pod is created once the
+// build queue has room for it.
+func nextAttempt(pod *v1.Pod) *v1.Pod {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	retries, _ := strconv.Atoi(annotations["triggr.crewjam.com/retries"])
+	attempt := podAttempt(pod)
+	if attempt > retries {
+		return nil
+	}
+	kind := failureKind(pod)
+	if kind == "" {
+		return nil
+	}
+	retry := false
+	for _, retryOn := range strings.Split(annotations["triggr.crewjam.com/retry-on"], ",") {
+		if retryOn == kind {
+			retry = true
+		}
+	}
+	if !retry {
+		return nil
+	}
+
+	suffix := fmt.Sprintf("-attempt-%d", attempt)
+	nextSuffix := fmt.Sprintf("-attempt-%d", attempt+1)
+	gistFileName := strings.TrimSuffix(annotations["triggr.crewjam.com/output-gist-file-name"], ".txt")
+
+	next := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            strings.TrimSuffix(pod.GetName(), suffix) + nextSuffix,
+			Labels:          map[string]string{},
+			Annotations:     map[string]string{},
+			OwnerReferences: pod.GetOwnerReferences(),
+		},
+		Spec: *pod.Spec.DeepCopy(),
+	}
+	for k, v := range pod.GetObjectMeta().GetLabels() {
+		next.ObjectMeta.Labels[k] = v
+	}
+	for k, v := range annotations {
+		next.ObjectMeta.Annotations[k] = v
+	}
+	delete(next.ObjectMeta.Annotations, "triggr.crewjam.com/timed-out")
+	next.ObjectMeta.Annotations["triggr.crewjam.com/github-last-status"] = "pending"
+	next.ObjectMeta.Annotations["triggr.crewjam.com/attempt"] = strconv.Itoa(attempt + 1)
+	next.ObjectMeta.Annotations["triggr.crewjam.com/output-gist-file-name"] =
+		strings.TrimSuffix(gistFileName, suffix) + nextSuffix + ".txt"
+
+	// start over on whatever node the scheduler likes, with the deadline
+	// the task asked for rather than one set by stopPod.
+	next.Spec.NodeName = ""
+	next.Spec.ActiveDeadlineSeconds = nil
+	if timeout, err := time.ParseDuration(annotations["triggr.crewjam.com/timeout"]); err == nil {
+		seconds := int64(timeout / time.Second)
+		next.Spec.ActiveDeadlineSeconds = &seconds
+	}
+	next.ObjectMeta.Namespace = pod.GetNamespace()
+	return next
+}
+
+// retryTask returns the Builder for the build that created pod, and the task
+// that pod runs.
+func retryTask(ctx context.Context, pod *v1.Pod) (*Builder, TaskConfig, error) {
+	b, err := builderFromPod(ctx, pod)
+	if err != nil {
+		return nil, TaskConfig{}, err
+	}
+	statusContext := pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/github-status-context"]
+	for _, task := range b.Config.Tasks {
+		if b.statusContext(task) == statusContext {
+			return b, task, nil
+		}
+	}
+	return nil, TaskConfig{}, fmt.Errorf("cannot find task %s", statusContext)
+}
+
+// runRetry creates pod, the next attempt at task, once the build queue has
+// room for it. It returns true if the pod was created.
+func (b *Builder) runRetry(ctx context.Context, task TaskConfig, pod *v1.Pod) (bool, error) {
+	_, err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Create(pod)
+	if err != nil && !apierrors.IsAlreadyExists(err) {
+		err = fmt.Errorf("cannot create pod: %v", err)
+		if err := b.setStatus(ctx, task, "error", err.Error()); err != nil {
+			return false, err
+		}
+		return false, err
+	}
+	if err := recordTaskCreated(pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/task-run"], true); err != nil {
+		log.Printf("%s: %v", pod.GetName(), err)
+	}
+	return true, nil
+}
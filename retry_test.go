@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestFailureKind(t *testing.T) {
+	terminated := func(name, reason string, exitCode int32) v1.ContainerStatus {
+		return v1.ContainerStatus{Name: name, State: v1.ContainerState{
+			Terminated: &v1.ContainerStateTerminated{Reason: reason, ExitCode: exitCode},
+		}}
+	}
+	tests := []struct {
+		name   string
+		status v1.PodStatus
+		want   string
+	}{
+		{"succeeded", v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+			terminated("exec", "Completed", 0)}}, ""},
+		{"failed", v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+			terminated("exec", "Error", 1)}}, "failure"},
+		{"out of memory", v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{
+			terminated("exec", "OOMKilled", 137)}}, "oom"},
+		{"evicted", v1.PodStatus{Reason: "Evicted"}, "evicted"},
+		{"image pull", v1.PodStatus{ContainerStatuses: []v1.ContainerStatus{{
+			Name:  "exec",
+			State: v1.ContainerState{Waiting: &v1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+		}}}, "image-pull"},
+		{"step failed", v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+			terminated("step-build", "Error", 2)}}, "failure"},
+		{"step out of memory", v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+			terminated("step-build", "OOMKilled", 137)}}, "oom"},
+		{"checkout failed", v1.PodStatus{InitContainerStatuses: []v1.ContainerStatus{
+			terminated("checkout", "Error", 128)}}, ""},
+	}
+	for _, tt := range tests {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+				"triggr.crewjam.com/steps": "build,test",
+			}},
+			Spec: v1.PodSpec{
+				InitContainers: []v1.Container{{Name: "checkout"}, {Name: "step-build"}},
+				Containers:     []v1.Container{{Name: "exec"}},
+			},
+			Status: tt.status,
+		}
+		if got := failureKind(pod); got != tt.want {
+			t.Errorf("%s: failureKind() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestNextAttempt(t *testing.T) {
+	evicted := func(name string, attempt, retries, retryOn string) *v1.Pod {
+		annotations := map[string]string{
+			"triggr.crewjam.com/retries":               retries,
+			"triggr.crewjam.com/retry-on":              retryOn,
+			"triggr.crewjam.com/timeout":               "10m",
+			"triggr.crewjam.com/timed-out":             "true",
+			"triggr.crewjam.com/github-last-status":    "error",
+			"triggr.crewjam.com/output-gist-file-name": "output-test.txt",
+		}
+		if attempt != "" {
+			annotations["triggr.crewjam.com/attempt"] = attempt
+			annotations["triggr.crewjam.com/output-gist-file-name"] = "output-test-attempt-" + attempt + ".txt"
+		}
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "ci", Annotations: annotations},
+			Spec:       v1.PodSpec{NodeName: "node-1", Containers: []v1.Container{{Name: "exec"}}},
+			Status:     v1.PodStatus{Reason: "Evicted"},
+		}
+	}
+	tests := []struct {
+		name        string
+		pod         *v1.Pod
+		wantName    string
+		wantAttempt string
+		wantGist    string
+	}{
+		{"first retry", evicted("triggr-test", "", "2", "evicted"),
+			"triggr-test-attempt-2", "2", "output-test-attempt-2.txt"},
+		{"second retry", evicted("triggr-test-attempt-2", "2", "2", "evicted,oom"),
+			"triggr-test-attempt-3", "3", "output-test-attempt-3.txt"},
+		{"out of retries", evicted("triggr-test-attempt-3", "3", "2", "evicted"), "", "", ""},
+		{"not retried for this", evicted("triggr-test", "", "2", "oom"), "", "", ""},
+		{"no retries", evicted("triggr-test", "", "", ""), "", "", ""},
+	}
+	for _, tt := range tests {
+		next := nextAttempt(tt.pod)
+		if tt.wantName == "" {
+			if next != nil {
+				t.Errorf("%s: nextAttempt() = %s, want nil", tt.name, next.GetName())
+			}
+			continue
+		}
+		if next == nil {
+			t.Errorf("%s: nextAttempt() = nil, want %s", tt.name, tt.wantName)
+			continue
+		}
+		annotations := next.GetAnnotations()
+		if next.GetName() != tt.wantName {
+			t.Errorf("%s: name = %s, want %s", tt.name, next.GetName(), tt.wantName)
+		}
+		if got := annotations["triggr.crewjam.com/attempt"]; got != tt.wantAttempt {
+			t.Errorf("%s: attempt = %s, want %s", tt.name, got, tt.wantAttempt)
+		}
+		if got := annotations["triggr.crewjam.com/output-gist-file-name"]; got != tt.wantGist {
+			t.Errorf("%s: gist file = %s, want %s", tt.name, got, tt.wantGist)
+		}
+		if got := annotations["triggr.crewjam.com/github-last-status"]; got != "pending" {
+			t.Errorf("%s: last status = %s, want pending", tt.name, got)
+		}
+		if _, ok := annotations["triggr.crewjam.com/timed-out"]; ok {
+			t.Errorf("%s: still marked as timed out", tt.name)
+		}
+		if next.Spec.NodeName != "" {
+			t.Errorf("%s: still on node %s", tt.name, next.Spec.NodeName)
+		}
+		if d := next.Spec.ActiveDeadlineSeconds; d == nil || *d != 600 {
+			t.Errorf("%s: deadline = %v, want 600", tt.name, d)
+		}
+		if tt.pod.GetAnnotations()["triggr.crewjam.com/github-last-status"] != "error" {
+			t.Errorf("%s: the old pod was changed", tt.name)
+		}
+	}
+}
+
+func TestAttemptCount(t *testing.T) {
+	tests := []struct {
+		retries string
+		want    string
+	}{
+		{"", "1"},
+		{"0", "1"},
+		{"2", "3"},
+	}
+	for _, tt := range tests {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{
+			"triggr.crewjam.com/retries": tt.retries,
+		}}}
+		if got := attemptCount(pod); got != tt.want {
+			t.Errorf("attemptCount() with retries %q = %s, want %s", tt.retries, got, tt.want)
+		}
+	}
+}
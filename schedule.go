@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v39/github"
+	"github.com/robfig/cron"
+)
+
+// runScheduler starts the scheduled builds of the repositories named by
+// -schedule-repos. Every minute it checks which of their tasks are due.
+func runScheduler() {
+	if *scheduleRepos == "" {
+		return
+	}
+	repos := strings.Split(*scheduleRepos, ",")
+
+	last := time.Now()
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, repo := range repos {
+			if err := scheduleBuild(context.Background(), strings.TrimSpace(repo), last, now); err != nil {
+				log.Printf("scheduleBuild: %s: %v", repo, err)
+			}
+		}
+		last = now
+	}
+}
+
+// scheduleRefreshInterval is how often the scheduler looks for changes to
+// the schedules of a repository when none of its tasks are due.
+const scheduleRefreshInterval = 15 * time.Minute
+
+// repoSchedule is what the scheduler knows of a repository: the head of its
+// default branch and the configuration there, as of Fetched.
+type repoSchedule struct {
+	Repo    *github.Repository
+	SHA     string
+	Config  Config
+	Fetched time.Time
+}
+
+// repoSchedules holds the schedule of each repository, keyed by full name,
+// so that the repository isn't fetched every minute. Only the scheduler uses
+// it.
+var repoSchedules = map[string]*repoSchedule{}
+
+// scheduleBuild builds the head of the default branch of repo if any of its
+// tasks were scheduled to run after last and no later than now.
+func scheduleBuild(ctx context.Context, repoFullName string, last, now time.Time) error {
+	parts := strings.SplitN(repoFullName, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected owner/name")
+	}
+	owner, name := parts[0], parts[1]
+
+	rs := repoSchedules[repoFullName]
+	fresh := false
+	if rs == nil || now.Sub(rs.Fetched) >= scheduleRefreshInterval {
+		var err error
+		if rs, err = fetchSchedule(ctx, owner, name, rs, now); err != nil {
+			return err
+		}
+		fresh = true
+	}
+	due, err := rs.Config.dueTasks(last, now)
+	if err != nil || len(due) == 0 {
+		return err
+	}
+	if !fresh {
+		// build what is there now, which may be scheduled differently
+		if rs, err = fetchSchedule(ctx, owner, name, rs, now); err != nil {
+			return err
+		}
+		if due, err = rs.Config.dueTasks(last, now); err != nil || len(due) == 0 {
+			return err
+		}
+	}
+
+	log.Printf("%s: starting scheduled build of %s at %s", repoFullName,
+		strings.Join(due, ", "), rs.SHA)
+	b := rs.builder(owner)
+	b.Only = due
+	return b.Build(ctx)
+}
+
+// fetchSchedule fetches the head of the default branch of owner/name and
+// records it in repoSchedules. The configuration is only fetched again if
+// the head has moved since prev.
+func fetchSchedule(ctx context.Context, owner, name string, prev *repoSchedule, now time.Time) (*repoSchedule, error) {
+	client, err := repoClient(ctx, owner, name)
+	if err != nil {
+		return nil, err
+	}
+	repo, _, err := client.Repositories.Get(ctx, owner, name)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch repository: %v", err)
+	}
+	branch, _, err := client.Repositories.GetBranch(ctx, owner, name, repo.GetDefaultBranch(), true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch branch %s: %v", repo.GetDefaultBranch(), err)
+	}
+
+	rs := &repoSchedule{Repo: repo, SHA: branch.GetCommit().GetSHA(), Fetched: now}
+	repoSchedules[repo.GetFullName()] = rs
+	if prev != nil && prev.SHA == rs.SHA {
+		rs.Config = prev.Config
+		return rs, nil
+	}
+	// a broken configuration is remembered as having no schedule, until it
+	// changes
+	b := rs.builder(owner)
+	if err := b.getConfig(ctx); err != nil {
+		return nil, err
+	}
+	rs.Config = b.Config
+	return rs, nil
+}
+
+// builder returns a Builder for a scheduled build of the head of the default
+// branch.
+func (rs *repoSchedule) builder(owner string) *Builder {
+	return &Builder{
+		Repo:  rs.Repo,
+		Event: "schedule",
+		SHA:   rs.SHA,
+		Ref:   "refs/heads/" + rs.Repo.GetDefaultBranch(),
+		Owner: owner,
+		Gist: &github.Gist{
+			Description: github.String(rs.Repo.GetFullName() + " Scheduled Build Status"),
+			Public:      github.Bool(false),
+			Files:       map[github.GistFilename]github.GistFile{},
+		},
+		Trusted: true,
+	}
+}
+
+// dueTasks returns the names of the tasks that were scheduled to run after
+// last and no later than now. The tasks are those of a scheduled build, which
+// getConfig has already cut down to the ones with a schedule of their own or
+// with schedule in their on. The schedule of the configuration doesn't add
+// any tasks; it only says when those without their own schedule run.
+func (c Config) dueTasks(last, now time.Time) ([]string, error) {
+	due := []string{}
+	for _, task := range c.Tasks {
+		spec := task.Schedule
+		if spec == "" {
+			spec = c.Schedule
+		}
+		if spec == "" {
+			continue
+		}
+		schedule, err := cron.ParseStandard(spec)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse schedule of task %s: %v", task.Name, err)
+		}
+		if !schedule.Next(last).After(now) && !contains(due, task.Name) {
+			due = append(due, task.Name)
+		}
+	}
+	return due, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
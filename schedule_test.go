@@ -0,0 +1,79 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDueTasks(t *testing.T) {
+	at := func(s string) time.Time {
+		tm, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tm
+	}
+	tests := []struct {
+		name    string
+		config  Config
+		last    string
+		now     string
+		want    []string
+		wantErr bool
+	}{
+		{"nothing scheduled",
+			Config{Tasks: []TaskConfig{{Name: "test"}}},
+			"2024-01-01T02:59:00Z", "2024-01-01T03:00:00Z", []string{}, false},
+		{"repository schedule due",
+			Config{Schedule: "0 3 * * *", Tasks: []TaskConfig{{Name: "integration"}}},
+			"2024-01-01T02:59:00Z", "2024-01-01T03:00:00Z", []string{"integration"}, false},
+		{"repository schedule not due",
+			Config{Schedule: "0 3 * * *", Tasks: []TaskConfig{{Name: "integration"}}},
+			"2024-01-01T03:00:00Z", "2024-01-01T03:01:00Z", []string{}, false},
+		{"task schedule overrides",
+			Config{Schedule: "0 3 * * *", Tasks: []TaskConfig{
+				{Name: "integration"},
+				{Name: "fuzz", Schedule: "0 1 * * 6"},
+			}},
+			"2024-01-06T00:59:00Z", "2024-01-06T01:00:00Z", []string{"fuzz"}, false},
+		{"missed minutes",
+			Config{Tasks: []TaskConfig{{Name: "fuzz", Schedule: "*/5 * * * *"}}},
+			"2024-01-01T03:01:00Z", "2024-01-01T03:07:00Z", []string{"fuzz"}, false},
+		{"matrix task once",
+			Config{Schedule: "0 3 * * *", Tasks: expandMatrix([]TaskConfig{
+				{Name: "test", Matrix: map[string][]string{"go": {"1.20", "1.21"}}},
+			})},
+			"2024-01-01T02:59:00Z", "2024-01-01T03:00:00Z", []string{"test"}, false},
+		{"bad schedule",
+			Config{Tasks: []TaskConfig{{Name: "fuzz", Schedule: "sometimes"}}},
+			"2024-01-01T02:59:00Z", "2024-01-01T03:00:00Z", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := tt.config.dueTasks(at(tt.last), at(tt.now))
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: dueTasks() error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: dueTasks() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRunsOnSchedule(t *testing.T) {
+	tests := []struct {
+		name string
+		task TaskConfig
+		want bool
+	}{
+		{"default events", TaskConfig{}, false},
+		{"on schedule", TaskConfig{On: []string{"schedule"}}, true},
+		{"own schedule", TaskConfig{Schedule: "0 1 * * 6"}, true},
+		{"on push only", TaskConfig{On: []string{"push"}}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.task.runsOn("schedule"); got != tt.want {
+			t.Errorf("%s: runsOn(schedule) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
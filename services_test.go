@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+)
+
+func TestAddServices(t *testing.T) {
+	postgres := ServiceConfig{
+		Name:  "postgres",
+		Image: "postgres:15",
+		Env:   map[string]string{"POSTGRES_USER": "test", "POSTGRES_PASSWORD": "secret"},
+		Ports: []int{5432},
+	}
+	tests := []struct {
+		name     string
+		services []ServiceConfig
+		want     []string
+		wantErr  bool
+	}{
+		{"none", nil, []string{"exec"}, false},
+		{"two", []ServiceConfig{postgres, {Name: "redis", Image: "redis:7"}},
+			[]string{"exec", "postgres", "redis"}, false},
+		{"exec", []ServiceConfig{{Name: "exec"}}, nil, true},
+		{"init container", []ServiceConfig{{Name: "checkout"}}, nil, true},
+		{"step", []ServiceConfig{{Name: "step-build"}}, nil, true},
+		{"same twice", []ServiceConfig{{Name: "redis"}, {Name: "redis"}}, nil, true},
+		{"upper case", []ServiceConfig{{Name: "Redis"}}, nil, true},
+		{"no name", []ServiceConfig{{Image: "redis:7"}}, nil, true},
+	}
+	for _, tt := range tests {
+		pod := &v1.Pod{Spec: v1.PodSpec{
+			InitContainers: []v1.Container{{Name: "checkout"}},
+			Containers:     []v1.Container{{Name: "exec"}},
+		}}
+		err := addServices(pod, TaskConfig{Services: tt.services})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: addServices() = %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		got := []string{}
+		for _, container := range pod.Spec.Containers {
+			got = append(got, container.Name)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: containers = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	pod := &v1.Pod{Spec: v1.PodSpec{Containers: []v1.Container{{Name: "exec"}}}}
+	if err := addServices(pod, TaskConfig{Services: []ServiceConfig{postgres}}); err != nil {
+		t.Fatal(err)
+	}
+	want := v1.Container{
+		Name:  "postgres",
+		Image: "postgres:15",
+		Env: []v1.EnvVar{
+			{Name: "POSTGRES_PASSWORD", Value: "secret"},
+			{Name: "POSTGRES_USER", Value: "test"},
+		},
+		Ports: []v1.ContainerPort{{ContainerPort: 5432}},
+	}
+	if got := pod.Spec.Containers[1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("service container = %+v, want %+v", got, want)
+	}
+}
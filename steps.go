@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+)
+
+const stepContainerPrefix = "step-"
+
+// maxContainerName is the longest name a container can have.
+const maxContainerName = 63
+
+// checkSteps makes sure that no task has both a command and steps, since the
+// steps replace the command, and that each step has a name that tells it
+// apart from the others in its container name too.
+func (c *Config) checkSteps() error {
+	for _, task := range c.Tasks {
+		if len(task.Steps) > 0 && len(task.Command) > 0 {
+			return fmt.Errorf("task %s has both a command and steps", task.Name)
+		}
+		containers := map[string]string{}
+		for i, step := range task.Steps {
+			switch {
+			case step.Name == "":
+				return fmt.Errorf("step %d of task %s has no name", i+1, task.Name)
+			case strings.Contains(step.Name, ","):
+				return fmt.Errorf("step %s of task %s has a comma in its name", step.Name, task.Name)
+			}
+			container := stepContainerName(step.Name)
+			if other, ok := containers[container]; ok && other == step.Name {
+				return fmt.Errorf("more than one step of task %s is named %s", task.Name, step.Name)
+			} else if ok {
+				return fmt.Errorf("steps %s and %s of task %s have names that are too much alike",
+					other, step.Name, task.Name)
+			}
+			containers[container] = step.Name
+		}
+	}
+	return nil
+}
+
+// addSteps arranges for pod to run the steps of task one after another.
+// All but the last step become init containers, which kubernetes runs in
+// order, and the last one runs in the exec container. Each step gets the same
+// environment, volumes and workspace as the exec container. The service
+// containers only start once the init containers are done, so only the last
+// step can reach the task's services.
+func addSteps(pod *v1.Pod, task TaskConfig, defaultImage string) {
+	exec := &pod.Spec.Containers[0]
+	names := []string{}
+	for i, step := range task.Steps {
+		names = append(names, step.Name)
+
+		image := step.Image
+		if image == "" {
+			image = defaultImage
+		}
+
+		if i == len(task.Steps)-1 {
+			exec.Image = image
+			exec.Args = step.Command
+			break
+		}
+		container := exec.DeepCopy()
+		container.Name = stepContainerName(step.Name)
+		container.Image = image
+		container.Args = step.Command
+		pod.Spec.InitContainers = append(pod.Spec.InitContainers, *container)
+	}
+	pod.ObjectMeta.Annotations["triggr.crewjam.com/steps"] = strings.Join(names, ",")
+}
+
+// podSteps returns the names of the steps of the task run by pod, in order,
+// along with the names of the containers they run in.
+func podSteps(pod *v1.Pod) (steps, containers []string) {
+	annotation := pod.GetObjectMeta().GetAnnotations()["triggr.crewjam.com/steps"]
+	if annotation == "" {
+		return nil, nil
+	}
+	steps = strings.Split(annotation, ",")
+	for i, step := range steps {
+		if i == len(steps)-1 {
+			containers = append(containers, pod.Spec.Containers[0].Name)
+			break
+		}
+		containers = append(containers, stepContainerName(step))
+	}
+	return steps, containers
+}
+
+// stepContainerName returns the name of the container that runs step,
+// which has to be a DNS label: lower case letters, digits and dashes, no
+// longer than 63 characters.
+func stepContainerName(step string) string {
+	name := strings.Trim(strings.Replace(podNameSafe(step), ".", "-", -1), "-")
+	return truncateName(stepContainerPrefix+name, maxContainerName)
+}
+
+// containerStep returns the name of the step that the named container of pod
+// runs, or an empty string if it doesn't run a step.
+func containerStep(pod *v1.Pod, container string) string {
+	steps, containers := podSteps(pod)
+	for i := range steps {
+		if containers[i] == container {
+			return steps[i]
+		}
+	}
+	return ""
+}
+
+// lastStep returns the name of the step that runs in the exec container of
+// pod, or an empty string if the task doesn't have steps.
+func lastStep(pod *v1.Pod) string {
+	return containerStep(pod, pod.Spec.Containers[0].Name)
+}
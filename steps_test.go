@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStepContainerName(t *testing.T) {
+	dnsLabel := regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+	tests := []struct {
+		step string
+		want string
+	}{
+		{"build", "step-build"},
+		{"Build Docs", "step-build-docs"},
+		{"go1.21", "step-go1-21"},
+		{"-lint-", "step-lint"},
+		{"test (race)", "step-test--race"},
+		{"", "step"},
+		{strings.Repeat("x", 80), ""},
+	}
+	for _, tt := range tests {
+		got := stepContainerName(tt.step)
+		if tt.want != "" && got != tt.want {
+			t.Errorf("stepContainerName(%q) = %q, want %q", tt.step, got, tt.want)
+		}
+		if len(got) > 63 || !dnsLabel.MatchString(got) {
+			t.Errorf("stepContainerName(%q) = %q, which is not a DNS label", tt.step, got)
+		}
+	}
+}
+
+func TestCheckSteps(t *testing.T) {
+	steps := func(names ...string) []StepConfig {
+		rv := []StepConfig{}
+		for _, name := range names {
+			rv = append(rv, StepConfig{Name: name, Command: []string{"true"}})
+		}
+		return rv
+	}
+	long := strings.Repeat("x", 80)
+	tests := []struct {
+		name    string
+		task    TaskConfig
+		wantErr bool
+	}{
+		{"command", TaskConfig{Command: []string{"make"}}, false},
+		{"steps", TaskConfig{Steps: steps("build", "test", "package")}, false},
+		{"command and steps", TaskConfig{Command: []string{"make"}, Steps: steps("build")}, true},
+		{"no name", TaskConfig{Steps: steps("build", "")}, true},
+		{"same name", TaskConfig{Steps: steps("build", "build")}, true},
+		{"same container name", TaskConfig{Steps: steps("build docs", "build-docs")}, true},
+		{"comma", TaskConfig{Steps: steps("build,test")}, true},
+		{"long names", TaskConfig{Steps: steps(long+"a", long+"b")}, false},
+	}
+	for _, tt := range tests {
+		tt.task.Name = "task"
+		c := &Config{Tasks: []TaskConfig{tt.task}}
+		if err := c.checkSteps(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkSteps() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPodSteps(t *testing.T) {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{}},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "exec"}}},
+	}
+	addSteps(pod, TaskConfig{Steps: []StepConfig{
+		{Name: "Build Docs"},
+		{Name: "test", Image: "golang"},
+		{Name: "package"},
+	}}, "alpine")
+
+	steps, containers := podSteps(pod)
+	if want := []string{"Build Docs", "test", "package"}; !reflect.DeepEqual(steps, want) {
+		t.Errorf("steps = %q, want %q", steps, want)
+	}
+	if want := []string{"step-build-docs", "step-test", "exec"}; !reflect.DeepEqual(containers, want) {
+		t.Errorf("containers = %q, want %q", containers, want)
+	}
+	for i, container := range pod.Spec.InitContainers {
+		if container.Name != containers[i] {
+			t.Errorf("init container %d is %s, want %s", i, container.Name, containers[i])
+		}
+	}
+	if got := []string{pod.Spec.InitContainers[0].Image, pod.Spec.InitContainers[1].Image, pod.Spec.Containers[0].Image}; !reflect.DeepEqual(got, []string{"alpine", "golang", "alpine"}) {
+		t.Errorf("images = %q", got)
+	}
+	if got := containerStep(pod, "step-test"); got != "test" {
+		t.Errorf("containerStep(step-test) = %q, want test", got)
+	}
+	if got := lastStep(pod); got != "package" {
+		t.Errorf("lastStep() = %q, want package", got)
+	}
+}
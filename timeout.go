@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxSavedOutput is how much of the output of a running pod is kept in case
+// the pod is deleted before it finishes.
+const maxSavedOutput = 256 * 1024
+
+// checkTimeouts makes sure that the timeouts of every task are durations of
+// at least a second, since kubernetes only deals in whole seconds and
+// rejects a deadline of zero.
+func (c *Config) checkTimeouts() error {
+	for _, task := range c.Tasks {
+		for _, t := range []struct {
+			Name  string
+			Value string
+		}{
+			{"timeout", task.Timeout},
+			{"no-output-timeout", task.NoOutputTimeout},
+		} {
+			if t.Value == "" {
+				continue
+			}
+			d, err := time.ParseDuration(t.Value)
+			if err != nil {
+				return fmt.Errorf("task %s has an invalid %s: %v", task.Name, t.Name, err)
+			}
+			if d < time.Second {
+				return fmt.Errorf("task %s has a %s of %s, which is less than a second", task.Name, t.Name, t.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// watchOutput starts watching the output of the named container of pod, if
+// we aren't already. The most recent output is kept in c.output, and if
+// timeout is not zero the pod is stopped if the container doesn't produce any
+// output for that long. The controller watches each step of a task in turn,
+// as it starts.
+func (c *Controller) watchOutput(pod *v1.Pod, container string, timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := string(pod.UID) + "/" + container
+	if c.watching[key] {
+		return
+	}
+	c.watching[key] = true
+	// the logs are read from the start, so any output kept from an earlier
+	// watch is read again.
+	output := &tailBuffer{Max: maxSavedOutput}
+	if c.output[pod.UID] == nil {
+		c.output[pod.UID] = map[string]*tailBuffer{}
+	}
+	c.output[pod.UID][container] = output
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.watching, key)
+			c.mu.Unlock()
+		}()
+		if err := watchOutput(pod, container, timeout, output); err != nil {
+			glog.Errorf("%s: cannot watch output: %v", pod.GetName(), err)
+		}
+	}()
+}
+
+func watchOutput(pod *v1.Pod, container string, timeout time.Duration, output *tailBuffer) error {
+	readCloser, err := kubeClient.CoreV1().Pods(pod.GetNamespace()).
+		GetLogs(pod.GetName(), &v1.PodLogOptions{
+			Container: container,
+			Follow:    true,
+		}).
+		Stream()
+	if err != nil {
+		return fmt.Errorf("cannot read output: %v", err)
+	}
+	defer readCloser.Close()
+
+	lastOutput := time.Now().UnixNano()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := readCloser.Read(buf)
+			if n > 0 {
+				output.Write(buf[:n])
+				atomic.StoreInt64(&lastOutput, time.Now().UnixNano())
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	if timeout == 0 {
+		<-done
+		return nil
+	}
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-ticker.C:
+			if time.Since(time.Unix(0, atomic.LoadInt64(&lastOutput))) > timeout {
+				reason := fmt.Sprintf("timed out: no output for %s", timeout)
+				if pod.GetObjectMeta().GetLabels()["job-name"] != "" {
+					return stopJob(pod, reason)
+				}
+				return stopPod(pod, reason)
+			}
+		}
+	}
+}
+
+// watchedContainer returns the name of the container of pod whose output is
+// watched now, which is the one running the current step of its task, or an
+// empty string if none of them is running.
+func watchedContainer(pod *v1.Pod) string {
+	_, containers := podSteps(pod)
+	if len(containers) == 0 {
+		containers = []string{pod.Spec.Containers[0].Name}
+	}
+	for _, containerStatus := range allContainerStatuses(pod) {
+		if containerStatus.State.Running != nil && contains(containers, containerStatus.Name) {
+			return containerStatus.Name
+		}
+	}
+	return ""
+}
+
+// savedOutput puts together the output of pod that was kept while it ran,
+// in the same form as podOutput.
+func savedOutput(pod *v1.Pod, output map[string]*tailBuffer) []byte {
+	steps, containers := podSteps(pod)
+	if len(steps) == 0 {
+		if buf, ok := output[pod.Spec.Containers[0].Name]; ok {
+			return buf.Bytes()
+		}
+		return nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for i, step := range steps {
+		out, ok := output[containers[i]]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(buf, "==> step %s <==\n", step)
+		buf.Write(out.Bytes())
+		fmt.Fprintln(buf)
+	}
+	return buf.Bytes()
+}
+
+// tailBuffer keeps the last Max bytes written to it.
+type tailBuffer struct {
+	Max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.Max {
+		t.buf = append([]byte{}, t.buf[len(t.buf)-t.Max:]...)
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of what the buffer holds.
+func (t *tailBuffer) Bytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte{}, t.buf...)
+}
+
+// stopPod makes kubernetes stop pod by moving its deadline up to now. Unlike
+// deleting the pod, this leaves the logs around for syncToStdout to collect.
+// The reason is recorded so that syncToStdout can report it.
+func stopPod(pod *v1.Pod, reason string) error {
+	pod, err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Get(pod.GetName(), metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("cannot fetch pod: %v", err)
+	}
+	deadline := int64(1)
+	if pod.Status.StartTime != nil {
+		deadline += int64(time.Since(pod.Status.StartTime.Time) / time.Second)
+	}
+	if pod.Spec.ActiveDeadlineSeconds != nil && *pod.Spec.ActiveDeadlineSeconds < deadline {
+		return nil
+	}
+	pod.Spec.ActiveDeadlineSeconds = &deadline
+	pod.ObjectMeta.Annotations["triggr.crewjam.com/timed-out"] = reason
+	if _, err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Update(pod); err != nil {
+		return fmt.Errorf("cannot update pod: %v", err)
+	}
+	glog.Infof("%s: %s", pod.GetName(), reason)
+	return nil
+}
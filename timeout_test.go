@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestCheckTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    TaskConfig
+		wantErr bool
+	}{
+		{"none", TaskConfig{Name: "test"}, false},
+		{"timeout", TaskConfig{Name: "test", Timeout: "30m"}, false},
+		{"no output timeout", TaskConfig{Name: "test", NoOutputTimeout: "5m"}, false},
+		{"one second", TaskConfig{Name: "test", Timeout: "1s", NoOutputTimeout: "1s"}, false},
+		{"unparseable", TaskConfig{Name: "test", Timeout: "forever"}, true},
+		{"no unit", TaskConfig{Name: "test", NoOutputTimeout: "30"}, true},
+		{"zero", TaskConfig{Name: "test", Timeout: "0s"}, true},
+		{"negative", TaskConfig{Name: "test", Timeout: "-5m"}, true},
+		{"under a second", TaskConfig{Name: "test", NoOutputTimeout: "500ms"}, true},
+	}
+	for _, tt := range tests {
+		c := &Config{Tasks: []TaskConfig{tt.task}}
+		if err := c.checkTimeouts(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: checkTimeouts() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
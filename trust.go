@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// awaitingApproval is the description of the status of the tasks of an
+// untrusted pull request that no maintainer has approved yet.
+const awaitingApproval = "awaiting approval"
+
+// okToTestLabel returns the label that approves building an untrusted pull
+// request.
+func okToTestLabel() string {
+	if *okToTestLabelFlag == "" {
+		return "ok-to-test"
+	}
+	return *okToTestLabelFlag
+}
+
+// untrustedPrivilege returns true if -untrusted-privileges gives untrusted
+// builds the privilege called name, either secrets or map-docker-sock.
+func untrustedPrivilege(name string) bool {
+	for _, privilege := range strings.Split(*untrustedPrivileges, ",") {
+		if strings.TrimSpace(privilege) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTrust works out whether the pull request being built can be trusted,
+// which it can if it comes from a branch of the repository itself, opened by
+// someone who can write to the repository. If it can't be trusted, it also
+// works out whether a maintainer has approved it by labelling it.
+func (b *Builder) checkTrust(ctx context.Context) error {
+	pr := b.PullRequest
+	for _, label := range pr.Labels {
+		if label.GetName() == okToTestLabel() {
+			b.Approved = true
+		}
+	}
+
+	b.Trusted = false
+	if pr.Head.GetRepo().GetFullName() != pr.Base.GetRepo().GetFullName() {
+		return nil
+	}
+	client, err := b.client(ctx)
+	if err != nil {
+		return err
+	}
+	permission, _, err := client.Repositories.GetPermissionLevel(ctx,
+		b.Owner, b.Repo.GetName(), pr.User.GetLogin())
+	if err != nil {
+		return fmt.Errorf("cannot fetch permission level: %v", err)
+	}
+	p := permission.GetPermission()
+	b.Trusted = p == "admin" || p == "write"
+	return nil
+}
+
+// approve labels the pull request being built as approved for building.
+func (b *Builder) approve(ctx context.Context) error {
+	client, err := b.client(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Issues.AddLabelsToIssue(ctx, b.Owner, b.Repo.GetName(),
+		b.PullRequest.GetNumber(), []string{okToTestLabel()})
+	if err != nil {
+		return fmt.Errorf("cannot add label: %v", err)
+	}
+	return nil
+}
+
+// awaitApproval marks the tasks of the build as pending until a maintainer
+// approves building it.
+func (b *Builder) awaitApproval(ctx context.Context) error {
+	for _, task := range b.Config.Tasks {
+		if b.skipReason(task) != "" {
+			continue
+		}
+		if err := b.setStatus(ctx, task, "pending", awaitingApproval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
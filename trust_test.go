@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/v39/github"
+)
+
+func TestUntrustedPrivilege(t *testing.T) {
+	tests := []struct {
+		flag string
+		name string
+		want bool
+	}{
+		{"", "secrets", false},
+		{"secrets", "secrets", true},
+		{"secrets, map-docker-sock", "map-docker-sock", true},
+		{"map-docker-sock", "secrets", false},
+	}
+	oldPrivileges := *untrustedPrivileges
+	defer func() { *untrustedPrivileges = oldPrivileges }()
+	for _, tt := range tests {
+		*untrustedPrivileges = tt.flag
+		if got := untrustedPrivilege(tt.name); got != tt.want {
+			t.Errorf("untrustedPrivilege(%s) with %q = %v, want %v", tt.name, tt.flag, got, tt.want)
+		}
+	}
+}
+
+func TestCheckTrust(t *testing.T) {
+	permissions := map[string]string{
+		"admin":       "admin",
+		"maintainer":  "write",
+		"triager":     "triage",
+		"contributor": "read",
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(r.URL.Path, "/")
+		if len(parts) != 7 || parts[4] != "collaborators" || parts[6] != "permission" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, `{"permission": %q}`, permissions[parts[5]])
+	}))
+	defer server.Close()
+	oldClient := githubClient
+	defer func() { githubClient = oldClient }()
+	githubClient = github.NewClient(nil)
+	githubClient.BaseURL, _ = url.Parse(server.URL + "/")
+
+	pullRequest := func(user, headRepo string, labels ...string) *github.PullRequest {
+		pr := &github.PullRequest{
+			User: &github.User{Login: github.String(user)},
+			Head: &github.PullRequestBranch{Repo: &github.Repository{FullName: github.String(headRepo)}},
+			Base: &github.PullRequestBranch{Repo: &github.Repository{FullName: github.String("crewjam/triggr")}},
+		}
+		for _, label := range labels {
+			pr.Labels = append(pr.Labels, &github.Label{Name: github.String(label)})
+		}
+		return pr
+	}
+	tests := []struct {
+		name         string
+		pr           *github.PullRequest
+		wantTrusted  bool
+		wantApproved bool
+	}{
+		{"admin", pullRequest("admin", "crewjam/triggr"), true, false},
+		{"maintainer", pullRequest("maintainer", "crewjam/triggr"), true, false},
+		{"triager", pullRequest("triager", "crewjam/triggr"), false, false},
+		{"fork", pullRequest("maintainer", "someone/triggr"), false, false},
+		{"approved fork", pullRequest("stranger", "stranger/triggr", "bug", "ok-to-test"), false, true},
+		{"other label", pullRequest("stranger", "stranger/triggr", "ok to test"), false, false},
+	}
+	for _, tt := range tests {
+		b := &Builder{
+			Repo:        &github.Repository{Name: github.String("triggr")},
+			Owner:       "crewjam",
+			PullRequest: tt.pr,
+		}
+		if err := b.checkTrust(context.Background()); err != nil {
+			t.Errorf("%s: checkTrust() = %v", tt.name, err)
+			continue
+		}
+		if b.Trusted != tt.wantTrusted || b.Approved != tt.wantApproved {
+			t.Errorf("%s: trusted %v and approved %v, want %v and %v",
+				tt.name, b.Trusted, b.Approved, tt.wantTrusted, tt.wantApproved)
+		}
+	}
+}
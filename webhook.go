@@ -7,16 +7,17 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/crewjam/errset"
-	"github.com/crewjam/httperr"
-	"github.com/google/go-github/github"
+	"github.com/google/go-github/v39/github"
 	"github.com/kr/pretty"
 	goji "goji.io"
 	"goji.io/pat"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
 )
 
@@ -25,7 +26,14 @@ func runServer() {
 		*listenAddress = ":8000"
 	}
 	mux := goji.NewMux()
-	mux.Handle(pat.Post("/event"), httperr.HandlerFunc(handleEvent))
+	mux.Handle(pat.Post("/event"), errorHandler(handleEvent))
+	mux.Handle(pat.Get("/broker/git/:owner/:repo/*"), brokerHandler(handleBrokerGit))
+	mux.Handle(pat.Post("/broker/git/:owner/:repo/*"), brokerHandler(handleBrokerGit))
+	mux.Handle(pat.Put("/broker/gist"), brokerHandler(handleBrokerGist))
+	mux.Handle(pat.Post("/broker/status"), brokerHandler(handleBrokerStatus))
+	if artifactStore != nil {
+		mux.Handle(pat.Get("/artifacts/*"), http.StripPrefix("/artifacts", artifactStore))
+	}
 	http.ListenAndServe(*listenAddress, mux)
 }
 
@@ -56,12 +64,22 @@ func handleEvent(w http.ResponseWriter, r *http.Request) error {
 			log.Printf("handlePullRequest: %v", err)
 		}
 		return err
+	case *github.IssueCommentEvent:
+		if event.GetAction() != "created" || !event.Issue.IsPullRequest() {
+			return nil
+		}
+		err := handleIssueComment(r.Context(), event)
+		if err != nil {
+			log.Printf("handleIssueComment: %v", err)
+		}
+		return err
 	case *github.PushEvent:
-		if event.GetRef() == "refs/heads/master" {
-			err := handlePush(r.Context(), event)
-			if err != nil {
-				log.Printf("handlePush: %v", err)
-			}
+		if event.GetDeleted() {
+			return nil
+		}
+		err := handlePush(r.Context(), event)
+		if err != nil {
+			log.Printf("handlePush: %v", err)
 		}
 		return err
 	}
@@ -71,6 +89,7 @@ func handleEvent(w http.ResponseWriter, r *http.Request) error {
 type Builder struct {
 	//Event     *github.PullRequestEvent
 	Repo        Repo
+	Event       string // push, tag, pull-request or schedule
 	SHA         string
 	Ref         string
 	Owner       string
@@ -78,18 +97,107 @@ type Builder struct {
 	Config      Config
 	TargetURL   string
 	PullRequest *github.PullRequest
+
+	// ChangedFiles lists the files changed by the push or pull request, or
+	// is nil if they are not known.
+	ChangedFiles []string
+
+	// Only lists the names of the tasks to build, if not all of them.
+	Only []string
+
+	// Manual is true if the tasks in Only were asked for explicitly, in
+	// which case they run regardless of their event and filters.
+	Manual bool
+
+	// Trusted is false for pull requests from forks or from people who
+	// can't write to the repository. Such builds only run once Approved,
+	// and don't get secrets or the docker socket unless
+	// -untrusted-privileges allows it.
+	Trusted  bool
+	Approved bool
+
+	// BuildName is the name of the Build resource that records the build.
+	BuildName string
 }
 
 type Config struct {
-	Image string
-	Tasks []TaskConfig `toml:"task"`
+	Image        string
+	PushBranches []string     `toml:"push-branches"` // globs; overrides -push-branches
+	Schedule     string       // cron spec for the tasks with schedule in their on
+	Concurrency  string       // "cancel-in-progress" stops builds of older revisions
+	Tasks        []TaskConfig `toml:"task"`
+
+	// AllTasks holds every task of the configuration, including the ones
+	// that are not part of this build but may still be needed by those
+	// that are.
+	AllTasks []TaskConfig `toml:"-"`
+}
+
+// allTasks returns every task of the configuration. Builds recorded before
+// AllTasks was kept only know their own tasks.
+func (c Config) allTasks() []TaskConfig {
+	if c.AllTasks == nil {
+		return c.Tasks
+	}
+	return c.AllTasks
 }
 
 type TaskConfig struct {
 	Name          string
 	Image         string
 	Command       []string
-	MapDockerSock bool `toml:"map-docker-sock"` // Danger, Will Robinson.
+	Needs         []string // tasks that must succeed before this one starts
+	Matrix        map[string][]string
+	Paths         []string // globs; run only when a changed file matches
+	PathsIgnore   []string `toml:"paths-ignore"`
+	Branches      []string // globs; run only when the branch matches
+	On            []string // events to run on; push and pull-request by default
+	Schedule      string   // cron spec; overrides the repository's schedule
+	MapDockerSock bool     `toml:"map-docker-sock"` // Danger, Will Robinson.
+
+	CPU              string
+	Memory           string
+	EphemeralStorage string            `toml:"ephemeral-storage"`
+	NodeSelector     map[string]string `toml:"node-selector"`
+	Tolerations      []TolerationConfig
+	PriorityClass    string `toml:"priority-class"`
+
+	Timeout         string // e.g. "30m"
+	NoOutputTimeout string `toml:"no-output-timeout"`
+
+	Retries int      // how many more times to try a failed task
+	RetryOn []string `toml:"retry-on"` // failure, evicted, oom or image-pull
+
+	Services []ServiceConfig `toml:"service"`
+	Steps    []StepConfig    `toml:"step"`
+
+	CloneDepth int  `toml:"clone-depth"` // 0 fetches the whole history
+	Submodules bool // check out submodules too
+	LFS        bool `toml:"lfs"` // fetch git LFS objects
+
+	Artifacts []string // patterns of files in the workspace to keep
+	Cache     []CacheConfig
+
+	// Variant holds the matrix values for this copy of the task, as
+	// produced by expandMatrix.
+	Variant map[string]string `toml:"-"`
+}
+
+// ServiceConfig describes a container that runs alongside a task, such as a
+// database for its tests to use.
+type ServiceConfig struct {
+	Name  string
+	Image string
+	Env   map[string]string
+	Ports []int
+}
+
+// StepConfig describes one of a sequence of commands that together make up
+// a task.
+type StepConfig struct {
+	Name    string
+	Image   string
+	Command []string
 }
 
 type Repo interface {
@@ -100,6 +208,7 @@ type Repo interface {
 func handlePush(ctx context.Context, event *github.PushEvent) error {
 	b := Builder{
 		Repo:  event.Repo,
+		Event: "push",
 		SHA:   event.HeadCommit.GetID(),
 		Ref:   event.GetRef(),
 		Owner: event.Repo.Owner.GetName(),
@@ -108,6 +217,21 @@ func handlePush(ctx context.Context, event *github.PushEvent) error {
 			Public:      github.Bool(false),
 			Files:       map[github.GistFilename]github.GistFile{},
 		},
+		Trusted: true,
+	}
+	if strings.HasPrefix(b.Ref, "refs/tags/") {
+		b.Event = "tag"
+	}
+
+	// The event lists at most 20 commits, so for bigger pushes (and for
+	// new branches) we don't know which files changed.
+	if !event.GetCreated() && event.GetSize() == len(event.Commits) {
+		b.ChangedFiles = []string{}
+		for _, commit := range event.Commits {
+			b.ChangedFiles = append(b.ChangedFiles, commit.Added...)
+			b.ChangedFiles = append(b.ChangedFiles, commit.Removed...)
+			b.ChangedFiles = append(b.ChangedFiles, commit.Modified...)
+		}
 	}
 	return b.Build(ctx)
 }
@@ -115,7 +239,7 @@ func handlePush(ctx context.Context, event *github.PushEvent) error {
 func handlePullRequestClosed(ctx context.Context, event *github.PullRequestEvent) error {
 	log.Printf("pr %d was closed, deleting resources", event.PullRequest.GetNumber())
 
-	errs := errset.ErrSet{}
+	errs := errorList{}
 	propagationPolicy := metav1.DeletePropagationBackground
 
 	ns, err := kubeClient.CoreV1().Namespaces().List(metav1.ListOptions{
@@ -147,58 +271,153 @@ func handlePullRequestClosed(ctx context.Context, event *github.PullRequestEvent
 		errs = append(errs, fmt.Errorf("cannot delete pods: %v", err))
 	}
 
+	// the jobs would only replace their pods
+	if runAsJobs() {
+		err = kubeClient.BatchV1().Jobs(*kubeNamespace).DeleteCollection(
+			&metav1.DeleteOptions{
+				PropagationPolicy: &propagationPolicy,
+			},
+			metav1.ListOptions{
+				LabelSelector: "pr=" + strconv.Itoa(event.PullRequest.GetNumber()),
+			})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cannot delete jobs: %v", err))
+		}
+	}
+
 	return errs.ReturnValue()
 }
 
 func handlePullRequest(ctx context.Context, event *github.PullRequestEvent) error {
-	b := Builder{
-		Repo:        event.PullRequest.Base.Repo,
-		PullRequest: event.PullRequest,
-		SHA:         event.PullRequest.Head.GetSHA(),
-		Ref:         fmt.Sprintf("refs/pull/%d/merge", event.PullRequest.GetNumber()),
-		Owner:       event.PullRequest.Base.Repo.Owner.GetLogin(),
+	// adding the approval label builds the pull request, but other labels
+	// don't change anything.
+	if event.GetAction() == "labeled" && event.Label.GetName() != okToTestLabel() {
+		return nil
+	}
+	b := newPullRequestBuilder(event.PullRequest)
+	return b.Build(ctx)
+}
+
+func newPullRequestBuilder(pr *github.PullRequest) *Builder {
+	return &Builder{
+		Repo:        pr.Base.Repo,
+		Event:       "pull-request",
+		PullRequest: pr,
+		SHA:         pr.Head.GetSHA(),
+		Ref:         fmt.Sprintf("refs/pull/%d/merge", pr.GetNumber()),
+		Owner:       pr.Base.Repo.Owner.GetLogin(),
 		Gist: &github.Gist{
-			Description: github.String(event.PullRequest.Base.Repo.GetFullName() + " Build Status"),
+			Description: github.String(pr.Base.Repo.GetFullName() + " Build Status"),
 			Public:      github.Bool(false),
 			Files:       map[github.GistFilename]github.GistFile{},
 		},
 	}
-	return b.Build(ctx)
 }
 
 func (b *Builder) Build(ctx context.Context) error {
 	if err := b.getConfig(ctx); err != nil {
 		return err
 	}
+	if b.Event == "push" && !matchAny(b.pushBranches(), b.branch()) {
+		log.Printf("%s: not building push to %s", b.Repo.GetFullName(), b.Ref)
+		return nil
+	}
+	if b.Config.Concurrency == "cancel-in-progress" {
+		if err := b.cancelSuperseded(ctx); err != nil {
+			log.Printf("%s: cannot cancel superseded builds: %v", b.Repo.GetFullName(), err)
+		}
+	}
+	if err := b.getChangedFiles(ctx); err != nil {
+		return err
+	}
+	if b.Event == "pull-request" {
+		if err := b.checkTrust(ctx); err != nil {
+			return err
+		}
+		if !b.Trusted && !b.Approved {
+			log.Printf("%s: pull request #%d is awaiting approval", b.Repo.GetFullName(),
+				b.PullRequest.GetNumber())
+			return b.awaitApproval(ctx)
+		}
+	}
 	if err := b.writeGist(ctx); err != nil {
 		return err
 	}
+	if err := b.recordBuild(); err != nil {
+		return err
+	}
+	waiting := false
 	for _, task := range b.Config.Tasks {
+		if reason := b.skipReason(task); reason != "" {
+			if err := b.setStatus(ctx, task, "success", "skipped: "+reason); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(task.Needs) > 0 {
+			if err := b.waitTask(ctx, task); err != nil {
+				return err
+			}
+			waiting = true
+			continue
+		}
 		if err := b.startTask(ctx, task); err != nil {
 			return err
 		}
 	}
+
+	// the tasks being waited for may have been skipped, or may not be part
+	// of this build at all, in which case no pod finishing will start the
+	// tasks waiting for them.
+	if waiting {
+		return b.startReady(ctx)
+	}
 	return nil
 }
 
 func (b *Builder) getConfig(ctx context.Context) error {
-	configFileContent, _, _, err := githubClient.Repositories.GetContents(ctx,
-		b.Owner,
-		b.Repo.GetName(),
-		".triggr.toml",
-		&github.RepositoryContentGetOptions{
-			Ref: b.SHA,
-		})
+	configBuf, err := b.fileContent(ctx, ".triggr.toml")
 	if err != nil {
-		return fmt.Errorf("cannot fetch .triggr.toml file: %v", err)
-	}
-	configBuf, err := configFileContent.GetContent()
-	if err != nil {
-		return fmt.Errorf("cannot parse .triggr.toml file: %v", err)
+		return err
 	}
+	b.Config = Config{}
 	if _, err := toml.Decode(configBuf, &b.Config); err != nil {
 		return fmt.Errorf("cannot parse .triggr.toml file TOML: %v", err)
 	}
+	if err := b.Config.checkNeeds(); err != nil {
+		return fmt.Errorf("invalid .triggr.toml file: %v", err)
+	}
+	for _, task := range b.Config.Tasks {
+		if len(task.Needs) > 0 && !crdsInstalled {
+			return fmt.Errorf("task %s needs other tasks, which only works once the resources in crds.yaml are installed", task.Name)
+		}
+	}
+	if err := b.Config.checkSteps(); err != nil {
+		return fmt.Errorf("invalid .triggr.toml file: %v", err)
+	}
+	if err := b.Config.checkTimeouts(); err != nil {
+		return fmt.Errorf("invalid .triggr.toml file: %v", err)
+	}
+	if err := b.Config.checkMatrix(); err != nil {
+		return fmt.Errorf("invalid .triggr.toml file: %v", err)
+	}
+	b.Config.Tasks = expandMatrix(b.Config.Tasks)
+	if err := checkTaskIDs(b.Config.Tasks); err != nil {
+		return fmt.Errorf("invalid .triggr.toml file: %v", err)
+	}
+	b.Config.AllTasks = b.Config.Tasks
+
+	// drop the tasks that don't run on this kind of event
+	tasks := []TaskConfig{}
+	for _, task := range b.Config.Tasks {
+		if len(b.Only) > 0 && !contains(b.Only, task.Name) {
+			continue
+		}
+		if (b.Manual && len(b.Only) > 0) || task.runsOn(b.Event) {
+			tasks = append(tasks, task)
+		}
+	}
+	b.Config.Tasks = tasks
 	return nil
 }
 
@@ -231,18 +450,17 @@ func (b *Builder) writeGist(ctx context.Context) error {
 	fmt.Fprintln(mdBuf)
 
 	for _, task := range b.Config.Tasks {
-		fmt.Fprintln(mdBuf, "## Task", task.Name)
+		fmt.Fprintln(mdBuf, "## Task", task.ID())
 		fmt.Fprintln(mdBuf)
-		podName := fmt.Sprintf("triggr-%s-%s-%s-%s",
-			b.Owner,
-			b.Repo.GetName(),
-			b.SHA[:12],
-			task.Name)
+		podName := b.podName(task)
 		podLink := fmt.Sprintf("http://localhost:8001/api/v1/proxy/namespaces/kube-system/services/kubernetes-dashboard/#!/log/%s/%s/?namespace=%s",
 			*kubeNamespace, podName, *kubeNamespace)
 		fmt.Fprintf(mdBuf, "- [Pod %s](%s)\n", podName, podLink)
 		fmt.Fprintf(mdBuf, "- Tail Logs: `kubectl --namespace \"%s\" logs \"%s\" -f`\n", *kubeNamespace, podName)
 		fmt.Fprintf(mdBuf, "- Info: `kubectl --namespace \"%s\" get pods \"%s\" -o yaml`\n", *kubeNamespace, podName)
+		if len(task.Artifacts) > 0 && artifactStore != nil {
+			fmt.Fprintf(mdBuf, "- [Artifacts](%s)\n", artifactStore.URL(b.artifactPrefix(task)))
+		}
 		fmt.Fprintln(mdBuf)
 		fmt.Fprintln(mdBuf)
 	}
@@ -252,6 +470,11 @@ func (b *Builder) writeGist(ctx context.Context) error {
 		Content: github.String(string(mdBuf.Bytes())),
 	}
 
+	// an app can't write gists, so without a personal access token the
+	// output is only kept in the check runs.
+	if githubClient == nil {
+		return nil
+	}
 	gist, _, err := githubClient.Gists.Create(ctx, b.Gist)
 	if err != nil {
 		return fmt.Errorf("cannot write gist: %v", err)
@@ -261,40 +484,142 @@ func (b *Builder) writeGist(ctx context.Context) error {
 	return nil
 }
 
-func (b *Builder) startTask(ctx context.Context, task TaskConfig) error {
-	statusContext := *statusContext + "-" + task.Name
-	status := &github.RepoStatus{
-		State:       github.String("pending"),
-		TargetURL:   github.String(b.TargetURL),
-		Description: github.String("started"),
-		Context:     github.String(statusContext),
-	}
-	_, _, err := githubClient.Repositories.CreateStatus(ctx,
+// taskKey identifies task among the tasks run for the revision being built.
+// Scheduled builds get their own keys so that they don't clash with builds of
+// pushes of the same revision.
+func (b *Builder) taskKey(task TaskConfig) string {
+	if b.Event == "schedule" {
+		return "schedule-" + task.ID()
+	}
+	return task.ID()
+}
+
+func (b *Builder) statusContext(task TaskConfig) string {
+	return *statusContext + "-" + b.taskKey(task)
+}
+
+func (b *Builder) podName(task TaskConfig) string {
+	return shortName(fmt.Sprintf("triggr-%s-%s-%s-%s",
+		b.Owner,
+		b.Repo.GetName(),
+		b.SHA[:12],
+		podNameSafe(b.taskKey(task))))
+}
+
+// truncateDescription shortens description to fit github's limit on the
+// length of status descriptions.
+func truncateDescription(description string) string {
+	if len(description) > 140 {
+		return description[:130] + "..."
+	}
+	return description
+}
+
+// client returns a github client that can act on the repository being built.
+func (b *Builder) client(ctx context.Context) (*github.Client, error) {
+	return repoClient(ctx, b.Owner, b.Repo.GetName())
+}
+
+// setStatus sets the github status of task on the commit being built, or
+// its check run if -github-reporter is checks, and records it in the task's
+// TaskRun.
+func (b *Builder) setStatus(ctx context.Context, task TaskConfig, state, description string) error {
+	if err := b.reportStatus(ctx, task, state, description); err != nil {
+		return err
+	}
+	return b.recordTaskState(task, state, description)
+}
+
+// reportStatus reports the state of task to github.
+func (b *Builder) reportStatus(ctx context.Context, task TaskConfig, state, description string) error {
+	if reportChecks() {
+		r := checkReport{
+			Owner:       b.Owner,
+			Repo:        b.Repo.GetName(),
+			SHA:         b.SHA,
+			Name:        b.statusContext(task),
+			DetailsURL:  b.TargetURL,
+			State:       state,
+			Description: description,
+		}
+		if state == "pending" && description == "started" {
+			r.StartedAt = time.Now()
+		}
+		return setCheckRun(ctx, r)
+	}
+
+	client, err := b.client(ctx)
+	if err != nil {
+		return err
+	}
+	_, _, err = client.Repositories.CreateStatus(ctx,
 		b.Owner,
 		b.Repo.GetName(),
 		b.SHA,
-		status,
+		&github.RepoStatus{
+			State:       github.String(state),
+			TargetURL:   github.String(b.TargetURL),
+			Description: github.String(truncateDescription(description)),
+			Context:     github.String(b.statusContext(task)),
+		},
 	)
 	if err != nil {
 		return fmt.Errorf("cannot create status: %v", err)
 	}
+	return nil
+}
+
+// startTask queues task to be run as soon as the limits on running tasks
+// allow.
+func (b *Builder) startTask(ctx context.Context, task TaskConfig) error {
+	buildQueue.Add(b, task)
+	return nil
+}
+
+// runQueuedTask runs task once the build queue has made room for it. It
+// returns false if no pod was created for the task.
+func (b *Builder) runQueuedTask(ctx context.Context, task TaskConfig) (bool, error) {
+	if err := b.setStatus(ctx, task, "pending", "started"); err != nil {
+		return false, err
+	}
 
 	if err := b.runTask(ctx, task); err != nil {
 		log.Printf("runTask: %v", err)
-		status.State = github.String("error")
-		status.Description = github.String(err.Error())
-		if len(*status.Description) > 140 {
-			status.Description = github.String(err.Error()[:130] + "...")
-		}
-		_, _, err = githubClient.Repositories.CreateStatus(ctx,
-			b.Owner,
-			b.Repo.GetName(),
-			b.SHA,
-			status,
-		)
-		if err != nil {
-			return fmt.Errorf("cannot create status: %v", err)
+		if err := b.setStatus(ctx, task, "error", err.Error()); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// addServices adds a container to pod for each of the task's services. The
+// name of a service is the name of its container, so it must be a valid DNS
+// label that no other container of the pod has.
+func addServices(pod *v1.Pod, task TaskConfig) error {
+	for _, service := range task.Services {
+		if errs := validation.IsDNS1123Label(service.Name); len(errs) > 0 {
+			return fmt.Errorf("invalid service name %q: %s", service.Name, strings.Join(errs, ", "))
+		}
+		if containerSpec(pod, service.Name) != nil || strings.HasPrefix(service.Name, stepContainerPrefix) {
+			return fmt.Errorf("service may not be named %s", service.Name)
+		}
+		container := v1.Container{
+			Name:  service.Name,
+			Image: service.Image,
 		}
+		for _, key := range sortedKeys(service.Env) {
+			container.Env = append(container.Env, v1.EnvVar{
+				Name:  key,
+				Value: service.Env[key],
+			})
+		}
+		for _, port := range service.Ports {
+			container.Ports = append(container.Ports, v1.ContainerPort{
+				ContainerPort: int32(port),
+			})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, container)
 	}
 	return nil
 }
@@ -304,14 +629,22 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 	if task.Image != "" {
 		image = task.Image
 	}
+	resources, err := taskResources(task)
+	if err != nil {
+		return err
+	}
+	if task.NoOutputTimeout != "" {
+		if _, err := time.ParseDuration(task.NoOutputTimeout); err != nil {
+			return fmt.Errorf("invalid no-output-timeout: %v", err)
+		}
+	}
+	if task.MapDockerSock && !b.Trusted && !untrustedPrivilege("map-docker-sock") {
+		return fmt.Errorf("map-docker-sock is not allowed for untrusted pull requests")
+	}
 
 	pod := &v1.Pod{
 		ObjectMeta: metav1.ObjectMeta{
-			Name: fmt.Sprintf("triggr-%s-%s-%s-%s",
-				b.Owner,
-				b.Repo.GetName(),
-				b.SHA[:12],
-				task.Name),
+			Name: b.podName(task),
 			Labels: map[string]string{
 				"triggr": "true",
 				"task":   task.Name,
@@ -321,31 +654,41 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 			Annotations: map[string]string{
 				"triggr.crewjam.com/github-target-url":     b.TargetURL,
 				"triggr.crewjam.com/github-last-status":    "pending",
-				"triggr.crewjam.com/github-status-context": *statusContext + "-" + task.Name,
+				"triggr.crewjam.com/github-status-context": b.statusContext(task),
 				"triggr.crewjam.com/github-owner":          b.Owner,
 				"triggr.crewjam.com/github-repo":           b.Repo.GetName(),
 				"triggr.crewjam.com/github-ref":            b.SHA,
+				"triggr.crewjam.com/git-ref":               b.Ref,
+				"triggr.crewjam.com/event":                 b.Event,
+				"triggr.crewjam.com/only":                  strings.Join(b.Only, ","),
+				"triggr.crewjam.com/manual":                strconv.FormatBool(b.Manual),
+				"triggr.crewjam.com/trusted":               strconv.FormatBool(b.Trusted),
+				"triggr.crewjam.com/build":                 b.BuildName,
+				"triggr.crewjam.com/task-run":              b.taskRunName(task),
 				"triggr.crewjam.com/task-name":             task.Name,
 				"triggr.crewjam.com/output-gist":           b.Gist.GetID(),
-				"triggr.crewjam.com/output-gist-file-name": "output-" + task.Name + ".txt",
+				"triggr.crewjam.com/output-gist-file-name": "output-" + task.ID() + ".txt",
 			},
 		},
 		Spec: v1.PodSpec{
-			RestartPolicy: v1.RestartPolicyNever,
+			RestartPolicy:     v1.RestartPolicyNever,
+			NodeSelector:      task.NodeSelector,
+			Tolerations:       taskTolerations(task),
+			PriorityClassName: task.PriorityClass,
 			Containers: []v1.Container{
 				{
-					Name:  "exec",
-					Image: image,
-					Args:  task.Command,
+					Name:      "exec",
+					Image:     image,
+					Args:      task.Command,
+					Resources: resources,
 					Env: []v1.EnvVar{
 						{
 							Name:  "TRIGGR",
 							Value: "true",
 						},
 						{
-							Name: "GIT_CLONE_URL",
-							Value: fmt.Sprintf("https://%s:@github.com/%s.git",
-								*githubAccessToken, b.Repo.GetFullName()),
+							Name:  "TRIGGR_EVENT",
+							Value: b.Event,
 						},
 						{
 							Name:  "GIT_REF",
@@ -377,11 +720,7 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 						},
 						{
 							Name:  "GITHUB_STATUS_CONTEXT",
-							Value: *statusContext + "-" + task.Name,
-						},
-						{
-							Name:  "GITHUB_ACCESS_TOKEN",
-							Value: *githubAccessToken,
+							Value: b.statusContext(task),
 						},
 						{
 							Name:  "GIST_ID",
@@ -389,7 +728,7 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 						},
 						{
 							Name:  "GIST_FILE_NAME",
-							Value: task.Name + " output",
+							Value: task.ID() + " output",
 						},
 					},
 					ImagePullPolicy: "Always",
@@ -398,6 +737,22 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 		},
 	}
 
+	b.addCheckout(pod, task)
+	if len(task.Artifacts) > 0 {
+		if err := b.addArtifacts(pod, task); err != nil {
+			return err
+		}
+	}
+	if len(task.Cache) > 0 {
+		if err := b.addCaches(ctx, pod, task); err != nil {
+			return err
+		}
+	}
+
+	if err := addServices(pod, task); err != nil {
+		return err
+	}
+
 	// add environment variable for pull request
 	if b.PullRequest != nil {
 		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, v1.EnvVar{
@@ -407,12 +762,38 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 		pod.ObjectMeta.Labels["pr"] = strconv.Itoa(b.PullRequest.GetNumber())
 	}
 
-	// see about build secrets
-	{
-		secretWhen := "never"
-		if b.PullRequest != nil {
-			secretWhen = "pull-request"
+	if task.Timeout != "" {
+		timeout, err := time.ParseDuration(task.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+		seconds := int64(timeout / time.Second)
+		pod.Spec.ActiveDeadlineSeconds = &seconds
+		pod.ObjectMeta.Annotations["triggr.crewjam.com/timeout"] = task.Timeout
+	}
+	if task.NoOutputTimeout != "" {
+		pod.ObjectMeta.Annotations["triggr.crewjam.com/no-output-timeout"] = task.NoOutputTimeout
+	}
+	if task.Retries > 0 {
+		retryOn := task.RetryOn
+		if len(retryOn) == 0 {
+			retryOn = defaultRetryOn
 		}
+		pod.ObjectMeta.Annotations["triggr.crewjam.com/retries"] = strconv.Itoa(task.Retries)
+		pod.ObjectMeta.Annotations["triggr.crewjam.com/retry-on"] = strings.Join(retryOn, ",")
+	}
+
+	// add environment variables for the matrix values
+	for _, key := range sortedKeys(task.Variant) {
+		pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, v1.EnvVar{
+			Name:  matrixEnvName(key),
+			Value: task.Variant[key],
+		})
+	}
+
+	// see about build secrets
+	if b.Trusted || untrustedPrivilege("secrets") {
+		secretWhen := b.Event
 		if b.Ref == "refs/heads/master" {
 			secretWhen = "master"
 		}
@@ -463,10 +844,53 @@ func (b *Builder) runTask(ctx context.Context, task TaskConfig) error {
 		})
 	}
 
-	pod, err := kubeClient.CoreV1().Pods(*kubeNamespace).Create(pod)
+	// the pod belongs to the task's TaskRun, and goes when the Build does
+	if name := b.taskRunName(task); name != "" {
+		taskRun, err := getTaskRun(name)
+		if err != nil {
+			return fmt.Errorf("cannot get task run %s: %v", name, err)
+		}
+		pod.ObjectMeta.OwnerReferences = []metav1.OwnerReference{
+			crdOwnerReference("TaskRun", taskRun.GetName(), taskRun.GetUID()),
+		}
+	}
+
+	secretName, err := b.grantBrokerToken(task)
 	if err != nil {
 		return err
 	}
+	pod.ObjectMeta.Annotations["triggr.crewjam.com/broker-secret"] = secretName
+	b.addBrokerEnv(pod, secretName)
+
+	if len(task.Steps) > 0 {
+		addSteps(pod, task, image)
+	}
+	if err := limitResources(pod); err != nil {
+		revokeBrokerToken(secretName)
+		return err
+	}
+
+	if canRunAsJob(pod) {
+		job, err := createJob(pod)
+		if err != nil {
+			revokeBrokerToken(secretName)
+			return err
+		}
+		log.Print("created job ", job.GetName())
+		if err := recordTaskCreated(b.taskRunName(task), true); err != nil {
+			log.Printf("%s: %v", job.GetName(), err)
+		}
+		return nil
+	}
+
+	pod, err = kubeClient.CoreV1().Pods(*kubeNamespace).Create(pod)
+	if err != nil {
+		revokeBrokerToken(secretName)
+		return err
+	}
 	log.Print("created pod", pod.GetName())
+	if err := recordTaskCreated(b.taskRunName(task), true); err != nil {
+		log.Printf("%s: %v", pod.GetName(), err)
+	}
 	return nil
 }
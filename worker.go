@@ -1,16 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/google/go-github/github"
+	"github.com/google/go-github/v39/github"
+	batchv1 "k8s.io/api/batch/v1"
 	"k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
@@ -22,13 +27,38 @@ type Controller struct {
 	indexer  cache.Indexer
 	queue    workqueue.RateLimitingInterface
 	informer cache.Controller
+
+	// the Jobs that run tasks, with -task-kind jobs
+	jobIndexer  cache.Indexer
+	jobInformer cache.Controller
+
+	mu          sync.Mutex
+	watching    map[string]bool                      // containers whose output is being watched, by pod UID and name
+	output      map[types.UID]map[string]*tailBuffer // recent output of running pods, by container
+	deleted     map[string]*v1.Pod                   // last seen state of deleted pods, by key
+	deletedJobs map[string]*batchv1.Job              // last seen state of deleted jobs, by key
+	deleting    map[string]bool                      // pods and jobs that the controller deleted, by queue key
+	background  map[string]*backgroundWork           // work done on finished pods, by pod UID and name
+}
+
+// backgroundWork is something slow that the controller does to a finished
+// pod, such as copying its artifacts out, without holding up the other pods.
+type backgroundWork struct {
+	done bool
+	err  error
 }
 
 func NewController(queue workqueue.RateLimitingInterface, indexer cache.Indexer, informer cache.Controller) *Controller {
 	return &Controller{
-		informer: informer,
-		indexer:  indexer,
-		queue:    queue,
+		informer:    informer,
+		indexer:     indexer,
+		queue:       queue,
+		watching:    map[string]bool{},
+		output:      map[types.UID]map[string]*tailBuffer{},
+		deleted:     map[string]*v1.Pod{},
+		deletedJobs: map[string]*batchv1.Job{},
+		deleting:    map[string]bool{},
+		background:  map[string]*backgroundWork{},
 	}
 }
 
@@ -38,7 +68,12 @@ func (c *Controller) processNextItem() bool {
 		return false
 	}
 	defer c.queue.Done(key)
-	err := c.syncToStdout(key.(string))
+	var err error
+	if strings.HasPrefix(key.(string), jobKeyPrefix) {
+		err = c.syncJob(key.(string))
+	} else {
+		err = c.syncToStdout(key.(string))
+	}
 	c.handleErr(err, key)
 	return true
 }
@@ -55,7 +90,7 @@ func (c *Controller) syncToStdout(key string) error {
 		return err
 	}
 	if !exists {
-		return nil
+		return c.podDeleted(ctx, key)
 	}
 
 	pod := obj.(*v1.Pod)
@@ -65,90 +100,125 @@ func (c *Controller) syncToStdout(key string) error {
 	if annotations["triggr.crewjam.com/github-status-context"] == "" {
 		return nil
 	}
+	if annotations["triggr.crewjam.com/cancelled"] != "" {
+		return nil // whoever cancelled the task has already set the status
+	}
 
-	githubState := "pending"
-	for _, containerStatus := range pod.Status.ContainerStatuses {
-		t := containerStatus.State.Terminated
-		if t == nil {
-			continue
-		}
-		if t.Reason == "Completed" {
-			githubState = "success"
-		} else if t.Reason == "Error" {
-			githubState = "failure"
-		} else {
-			githubState = "error"
+	githubState, githubDescription := podState(pod)
+	if _, d := unschedulable(pod); githubState == "pending" && d > 0 {
+		// look again once the pod has had long enough to be scheduled
+		c.queue.AddAfter(key, unschedulableTimeout-d+time.Second)
+	}
+	if container := watchedContainer(pod); githubState == "pending" && container != "" {
+		timeout := time.Duration(0)
+		if value := annotations["triggr.crewjam.com/no-output-timeout"]; value != "" {
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				return fmt.Errorf("cannot parse no-output-timeout: %v", err)
+			}
 		}
-		break
+		c.watchOutput(pod, container, timeout)
 	}
 	if annotations["triggr.crewjam.com/github-last-status"] == githubState {
 		fmt.Printf("%s: githubState is unchanged %s\n", pod.GetName(), githubState)
 		return nil
 	}
 
-	// capture logs and update gist
-	gistID := annotations["triggr.crewjam.com/output-gist"]
-	if githubState != "pending" && gistID != "" {
-		gistFileName := annotations["triggr.crewjam.com/output-gist-file-name"]
-		if gistFileName == "" {
-			gistFileName = pod.GetName() + ".txt"
-		}
-
-		req := kubeClient.CoreV1().RESTClient().Get().
-			Namespace(pod.GetNamespace()).
-			Name(pod.GetName()).
-			Resource("pods").
-			SubResource("log").
-			Param("container", pod.Spec.Containers[0].Name)
-		readCloser, err := req.Stream()
-		if err != nil {
-			return fmt.Errorf("cannot read output: %v", err)
+	// the Job decides how its task ends, once its pod has finished. A pod
+	// that can't start never finishes, so that is up to the controller.
+	if jobName := pod.GetObjectMeta().GetLabels()["job-name"]; jobName != "" && githubState != "pending" {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			c.queue.Add(jobKeyPrefix + pod.GetNamespace() + "/" + jobName)
+			return nil
+		}
+		return c.failJob(ctx, pod, githubState, githubDescription)
+	}
+
+	// keep the artifacts of successful tasks
+	if githubState == "success" && annotations["triggr.crewjam.com/artifacts"] != "" {
+		done, err := c.inBackground(key, pod, "artifacts", func() error {
+			return collectArtifacts(context.Background(), pod)
+		})
+		if !done {
+			return nil // the pod is queued again once they are collected
 		}
-		out, err := ioutil.ReadAll(readCloser)
-		readCloser.Close()
 		if err != nil {
-			return fmt.Errorf("cannot read output: %v", err)
+			glog.Errorf("%s: %v", pod.GetName(), err)
+			githubState, githubDescription = "error", "cannot collect artifacts"
 		}
+	}
 
-		_, _, err = githubClient.Gists.Edit(ctx, gistID, &github.Gist{
-			Files: map[github.GistFilename]github.GistFile{
-				github.GistFilename(gistFileName): github.GistFile{
-					Type:    github.String("text/plain"),
-					Content: github.String(string(out)),
-				},
-			},
+	// failing to save the caches doesn't fail the task
+	if githubState == "success" && annotations["triggr.crewjam.com/cache"] != "" {
+		done, err := c.inBackground(key, pod, "caches", func() error {
+			return saveCaches(pod)
 		})
+		if !done {
+			return nil // the pod is queued again once they are saved
+		}
 		if err != nil {
-			return fmt.Errorf("cannot save gist: %v", err)
+			glog.Errorf("%s: %v", pod.GetName(), err)
 		}
 	}
 
-	// set github state
-	{
-		status := &github.RepoStatus{
-			State:       github.String(githubState),
-			TargetURL:   github.String(annotations["triggr.crewjam.com/github-target-url"]),
-			Description: github.String(githubState),
-			Context:     github.String(annotations["triggr.crewjam.com/github-status-context"]),
-		}
-		_, _, err = githubClient.Repositories.CreateStatus(ctx,
-			annotations["triggr.crewjam.com/github-owner"],
-			annotations["triggr.crewjam.com/github-repo"],
-			annotations["triggr.crewjam.com/github-ref"],
-			status,
-		)
+	// capture logs and update gist
+	var out []byte
+	if githubState != "pending" {
+		out, err = podOutput(pod)
 		if err != nil {
-			glog.Errorf("cannot set status %v", err)
 			return err
 		}
-		fmt.Printf("%s: set state to %s\n", pod.GetName(), githubState)
+	}
+	if githubState != "pending" {
+		if err := savePodOutput(ctx, pod, out); err != nil {
+			return err
+		}
+	}
+
+	// try again if the task failed in a way that the task wants retried
+	if githubState != "pending" {
+		if attempt := nextAttempt(pod); attempt != nil {
+			b, task, err := retryTask(ctx, pod)
+			if err != nil {
+				glog.Errorf("cannot retry pod: %v", err)
+				return err
+			}
+			description := fmt.Sprintf("retrying after %s (attempt %s of %s)",
+				githubDescription,
+				attempt.ObjectMeta.Annotations["triggr.crewjam.com/attempt"],
+				attemptCount(pod))
+			if err := setPodStatus(ctx, pod, "pending", description, nil); err != nil {
+				return err
+			}
+			if err := recordTaskCreated(annotations["triggr.crewjam.com/task-run"], false); err != nil {
+				return err
+			}
+			buildQueue.AddRetry(b, task, attempt)
+			fmt.Printf("%s: deleted pod, retrying as %s\n", pod.GetName(), attempt.GetName())
+			return c.deletePod(key, pod)
+		}
 	}
 
+	// set github state
+	if err := setPodStatus(ctx, pod, githubState, githubDescription, out); err != nil {
+		return err
+	}
+	fmt.Printf("%s: set state to %s\n", pod.GetName(), githubState)
+
+	// start the tasks that were waiting for this one
 	if githubState != "pending" {
+		if err := startDependents(ctx, pod); err != nil {
+			glog.Errorf("cannot start dependent tasks: %v", err)
+			return err
+		}
+	}
+
+	// deleting the pod also stops any service containers, which would
+	// otherwise keep running after the exec container is done.
+	if githubState != "pending" {
+		revokeBrokerToken(annotations["triggr.crewjam.com/broker-secret"])
 		fmt.Printf("%s: deleted pod\n", pod.GetName())
-		err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Delete(pod.GetName(), nil)
-		if err != nil {
-			glog.Errorf("cannot delete pod: %v", err)
+		if err := c.deletePod(key, pod); err != nil {
 			return err
 		}
 	} else {
@@ -160,8 +230,338 @@ func (c *Controller) syncToStdout(key string) error {
 		fmt.Printf("%s: updated pod\n", pod.GetName())
 	}
 
-	// TODO: collect logs, update gist, delete pod
+	return nil
+}
+
+// inBackground runs f, the work called name on pod, in its own goroutine and
+// queues the pod again when it is done. It returns whether the work is done
+// and, if so, how it went.
+func (c *Controller) inBackground(key string, pod *v1.Pod, name string, f func() error) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if work, ok := c.background[string(pod.UID)+"/"+name]; ok {
+		return work.done, work.err
+	}
+	work := &backgroundWork{}
+	c.background[string(pod.UID)+"/"+name] = work
+	go func() {
+		err := f()
+		c.mu.Lock()
+		work.done, work.err = true, err
+		c.mu.Unlock()
+		c.queue.Add(key)
+	}()
+	return false, nil
+}
+
+// deletePod deletes pod, which the controller has finished with.
+func (c *Controller) deletePod(key string, pod *v1.Pod) error {
+	c.mu.Lock()
+	c.deleting[key] = true
+	c.mu.Unlock()
+	if err := kubeClient.CoreV1().Pods(pod.GetNamespace()).Delete(pod.GetName(), nil); err != nil {
+		c.mu.Lock()
+		delete(c.deleting, key)
+		c.mu.Unlock()
+		glog.Errorf("cannot delete pod: %v", err)
+		return err
+	}
+	return nil
+}
+
+// podGone records the last seen state of a pod that has been deleted, for
+// podDeleted.
+func (c *Controller) podGone(key string, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	pod, ok := obj.(*v1.Pod)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	c.deleted[key] = pod
+	c.mu.Unlock()
+}
+
+// podDeleted handles a task pod that has been deleted. If the controller
+// didn't delete the pod itself, the task never finished, so its status is set
+// to error and whatever output was seen is saved.
+func (c *Controller) podDeleted(ctx context.Context, key string) error {
+	c.mu.Lock()
+	pod := c.deleted[key]
+	deleting := c.deleting[key]
+	delete(c.deleted, key)
+	delete(c.deleting, key)
+	var output []byte
+	if pod != nil {
+		if buffers, ok := c.output[pod.UID]; ok {
+			output = savedOutput(pod, buffers)
+		}
+		delete(c.output, pod.UID)
+		for name := range c.background {
+			if strings.HasPrefix(name, string(pod.UID)+"/") {
+				delete(c.background, name)
+			}
+		}
+	}
+	c.mu.Unlock()
+	if pod == nil || deleting {
+		return nil
+	}
+
+	// the Job reports on its own deletion. Its pods go with it, or when it
+	// gives up on them, but the output of a pod that was still running is
+	// worth keeping.
+	if jobName := pod.GetObjectMeta().GetLabels()["job-name"]; jobName != "" {
+		job := c.getJob(pod.GetNamespace(), jobName)
+		if job != nil && job.GetAnnotations()["triggr.crewjam.com/github-last-status"] == "pending" && len(output) > 0 {
+			if err := savePodOutput(ctx, pod, output); err != nil {
+				glog.Errorf("%s: %v", pod.GetName(), err)
+			}
+		}
+		return nil
+	}
+
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	if annotations["triggr.crewjam.com/github-status-context"] == "" {
+		return nil
+	}
+	if annotations["triggr.crewjam.com/cancelled"] != "" {
+		return nil
+	}
+	if annotations["triggr.crewjam.com/github-last-status"] != "pending" {
+		return nil
+	}
+
+	// the pod may have finished before it was deleted, but its output and
+	// artifacts are gone either way.
+	state, description := podState(pod)
+	if state == "pending" || state == "success" {
+		state, description = "error", "task pod was deleted before completion"
+	}
+	log.Printf("%s: pod was deleted: %s", pod.GetName(), description)
+
+	if err := savePodOutput(ctx, pod, output); err != nil {
+		glog.Errorf("%s: %v", pod.GetName(), err)
+	}
+	revokeBrokerToken(annotations["triggr.crewjam.com/broker-secret"])
+	if err := setPodStatus(ctx, pod, state, description, output); err != nil {
+		return err
+	}
+	return startDependents(ctx, pod)
+}
+
+// savePodOutput saves the output of the task run by pod in its gist file.
+func savePodOutput(ctx context.Context, pod *v1.Pod, out []byte) error {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	gistID := annotations["triggr.crewjam.com/output-gist"]
+	if gistID == "" {
+		return nil
+	}
+	gistFileName := annotations["triggr.crewjam.com/output-gist-file-name"]
+	if gistFileName == "" {
+		gistFileName = pod.GetName() + ".txt"
+	}
+
+	_, _, err := githubClient.Gists.Edit(ctx, gistID, &github.Gist{
+		Files: map[github.GistFilename]github.GistFile{
+			github.GistFilename(gistFileName): github.GistFile{
+				Type:    github.String("text/plain"),
+				Content: github.String(string(out)),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot save gist: %v", err)
+	}
+	return nil
+}
+
+// setPodStatus sets the github status of the task run by pod, or its check
+// run if -github-reporter is checks, and records it in the task's TaskRun.
+// The check run includes output, if it is not nil.
+func setPodStatus(ctx context.Context, pod *v1.Pod, state, description string, output []byte) error {
+	if err := reportPodStatus(ctx, pod, state, description, output); err != nil {
+		return err
+	}
+	if err := recordPodState(pod, state, description); err != nil {
+		glog.Errorf("cannot record task run state %v", err)
+		return err
+	}
+	return nil
+}
+
+// reportPodStatus reports the state of the task run by pod to github.
+func reportPodStatus(ctx context.Context, pod *v1.Pod, state, description string, output []byte) error {
+	if reportChecks() {
+		if err := setCheckRun(ctx, podCheckReport(pod, state, description, output)); err != nil {
+			glog.Errorf("cannot set check run %v", err)
+			return err
+		}
+		return nil
+	}
 
+	annotations := pod.GetObjectMeta().GetAnnotations()
+	status := &github.RepoStatus{
+		State:       github.String(state),
+		TargetURL:   github.String(annotations["triggr.crewjam.com/github-target-url"]),
+		Description: github.String(truncateDescription(description)),
+		Context:     github.String(annotations["triggr.crewjam.com/github-status-context"]),
+	}
+	client, err := repoClient(ctx,
+		annotations["triggr.crewjam.com/github-owner"],
+		annotations["triggr.crewjam.com/github-repo"])
+	if err != nil {
+		glog.Errorf("cannot set status %v", err)
+		return err
+	}
+	_, _, err = client.Repositories.CreateStatus(ctx,
+		annotations["triggr.crewjam.com/github-owner"],
+		annotations["triggr.crewjam.com/github-repo"],
+		annotations["triggr.crewjam.com/github-ref"],
+		status,
+	)
+	if err != nil {
+		glog.Errorf("cannot set status %v", err)
+		return err
+	}
+	return nil
+}
+
+// podState returns the github state and description for pod.
+func podState(pod *v1.Pod) (state, description string) {
+	annotations := pod.GetObjectMeta().GetAnnotations()
+
+	// the pod ran out of time, either because of the task timeout or
+	// because watchOutput shortened the deadline.
+	if pod.Status.Reason == "DeadlineExceeded" {
+		if reason := annotations["triggr.crewjam.com/timed-out"]; reason != "" {
+			return "error", reason
+		}
+		return "error", "timed out after " + annotations["triggr.crewjam.com/timeout"]
+	}
+
+	if pod.Status.Reason == "Evicted" {
+		if pod.Status.Message != "" {
+			return "error", "evicted: " + pod.Status.Message
+		}
+		return "error", "evicted"
+	}
+
+	// containers that can't start would otherwise wait forever
+	if description := waitingFailure(pod); description != "" {
+		return "error", description
+	}
+	if message, d := unschedulable(pod); d > unschedulableTimeout {
+		return "error", "cannot schedule pod: " + message
+	}
+
+	// the exec container never starts if an init container fails
+	for _, containerStatus := range pod.Status.InitContainerStatuses {
+		if t := containerStatus.State.Terminated; t != nil && t.ExitCode != 0 {
+			description := containerStatus.Name + " failed"
+			step := containerStep(pod, containerStatus.Name)
+			if step != "" {
+				description = "step " + step + " failed"
+			}
+			if t.Reason == "OOMKilled" {
+				return "error", description + ": " + oomDescription(pod, containerStatus.Name)
+			}
+			if step != "" {
+				return "failure", description
+			}
+			return "error", description
+		}
+	}
+
+	// the outcome is that of the exec container. Any other containers are
+	// services for it to use.
+	if containerStatus := execStatus(pod); containerStatus != nil {
+		if t := containerStatus.State.Terminated; t != nil {
+			if t.Reason == "Completed" {
+				return "success", "success"
+			} else if t.Reason == "Error" {
+				if step := lastStep(pod); step != "" {
+					return "failure", "step " + step + " failed"
+				}
+				return "failure", "failure"
+			} else if t.Reason == "OOMKilled" {
+				return "error", oomDescription(pod, containerStatus.Name)
+			} else if t.Reason != "" && t.Message != "" {
+				return "error", t.Reason + ": " + t.Message
+			} else if t.Reason != "" {
+				return "error", t.Reason
+			}
+			return "error", "error"
+		}
+	}
+	return "pending", "pending"
+}
+
+// podOutput returns the output of the task run by pod. For tasks with steps
+// the output of each step that ran is given its own section.
+func podOutput(pod *v1.Pod) ([]byte, error) {
+	steps, containers := podSteps(pod)
+	if len(steps) == 0 {
+		return containerOutput(pod, pod.Spec.Containers[0].Name)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	for i, step := range steps {
+		out, err := containerOutput(pod, containers[i])
+		if err != nil {
+			return nil, err
+		}
+		if out == nil {
+			continue
+		}
+		fmt.Fprintf(buf, "==> step %s <==\n", step)
+		buf.Write(out)
+		fmt.Fprintln(buf)
+	}
+	return buf.Bytes(), nil
+}
+
+// containerOutput returns the log of the named container in pod, or nothing
+// if the container never started.
+func containerOutput(pod *v1.Pod, container string) ([]byte, error) {
+	started := false
+	for _, containerStatus := range allContainerStatuses(pod) {
+		if containerStatus.Name == container {
+			started = containerStatus.State.Running != nil || containerStatus.State.Terminated != nil
+		}
+	}
+	if !started {
+		return nil, nil
+	}
+
+	req := kubeClient.CoreV1().RESTClient().Get().
+		Namespace(pod.GetNamespace()).
+		Name(pod.GetName()).
+		Resource("pods").
+		SubResource("log").
+		Param("container", container)
+	readCloser, err := req.Stream()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read output: %v", err)
+	}
+	defer readCloser.Close()
+	out, err := ioutil.ReadAll(readCloser)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read output: %v", err)
+	}
+	return out, nil
+}
+
+// execStatus returns the status of the container that runs the task's
+// command, or nil if it doesn't have a status yet.
+func execStatus(pod *v1.Pod) *v1.ContainerStatus {
+	for i, containerStatus := range pod.Status.ContainerStatuses {
+		if containerStatus.Name == pod.Spec.Containers[0].Name {
+			return &pod.Status.ContainerStatuses[i]
+		}
+	}
 	return nil
 }
 
@@ -186,10 +586,18 @@ func (c *Controller) Run(threadiness int, stopCh chan struct{}) {
 	defer c.queue.ShutDown()
 	glog.Info("Starting Pod controller")
 	go c.informer.Run(stopCh)
-	if !cache.WaitForCacheSync(stopCh, c.informer.HasSynced) {
+	synced := []cache.InformerSynced{c.informer.HasSynced}
+	if c.jobInformer != nil {
+		go c.jobInformer.Run(stopCh)
+		synced = append(synced, c.jobInformer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		runtime.HandleError(fmt.Errorf("Timed out waiting for caches to sync"))
 		return
 	}
+	// the TaskRuns without pods are taken care of before the pods are, so
+	// that the two don't both start the same task
+	c.reconcileBuilds()
 	for i := 0; i < threadiness; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
 	}
@@ -207,12 +615,16 @@ func runController() {
 		kubeClient.CoreV1().RESTClient(),
 		"pods", *kubeNamespace, fields.Everything())
 	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	var controller *Controller
 	indexer, informer := cache.NewIndexerInformer(podListWatcher, &v1.Pod{}, 0, cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(obj)
 			if err == nil {
 				queue.Add(key)
 			}
+			if pod, ok := obj.(*v1.Pod); ok {
+				buildQueue.PodStarted(pod)
+			}
 		},
 		UpdateFunc: func(old interface{}, new interface{}) {
 			key, err := cache.MetaNamespaceKeyFunc(new)
@@ -225,12 +637,44 @@ func runController() {
 			// key function.
 			key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
 			if err == nil {
+				controller.podGone(key, obj)
 				queue.Add(key)
+				buildQueue.PodStopped(key)
 			}
 		},
 	}, cache.Indexers{})
 
-	controller := NewController(queue, indexer, informer)
+	controller = NewController(queue, indexer, informer)
+	if runAsJobs() {
+		jobListWatcher := cache.NewListWatchFromClient(
+			kubeClient.BatchV1().RESTClient(),
+			"jobs", *kubeNamespace, fields.Everything())
+		controller.jobIndexer, controller.jobInformer = cache.NewIndexerInformer(jobListWatcher, &batchv1.Job{}, 0, cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(obj)
+				if err == nil {
+					queue.Add(jobKeyPrefix + key)
+				}
+				if job, ok := obj.(*batchv1.Job); ok {
+					buildQueue.JobStarted(job)
+				}
+			},
+			UpdateFunc: func(old interface{}, new interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(new)
+				if err == nil {
+					queue.Add(jobKeyPrefix + key)
+				}
+			},
+			DeleteFunc: func(obj interface{}) {
+				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+				if err == nil {
+					controller.jobGone(key, obj)
+					queue.Add(jobKeyPrefix + key)
+					buildQueue.PodStopped(key)
+				}
+			},
+		}, cache.Indexers{})
+	}
 	stop := make(chan struct{})
 	defer close(stop)
 	go controller.Run(1, stop)
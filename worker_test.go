@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		writes []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"abc"}, "abc"},
+		{[]string{"abc", "def"}, "bcdef"},
+		{[]string{"0123456789"}, "56789"},
+		{[]string{"0123456789", "x"}, "6789x"},
+	}
+	for _, tt := range tests {
+		buf := &tailBuffer{Max: 5}
+		for _, s := range tt.writes {
+			if n, err := buf.Write([]byte(s)); n != len(s) || err != nil {
+				t.Errorf("Write(%q) = %d, %v", s, n, err)
+			}
+		}
+		if got := string(buf.Bytes()); got != tt.want {
+			t.Errorf("after writing %q, got %q, want %q", tt.writes, got, tt.want)
+		}
+	}
+}
+
+func TestPodDeletedLeftAlone(t *testing.T) {
+	pod := func(annotations ...string) *v1.Pod {
+		rv := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:      "triggr-test",
+			Namespace: "ci",
+			UID:       "0123",
+			Annotations: map[string]string{
+				"triggr.crewjam.com/github-status-context": "triggr/test",
+				"triggr.crewjam.com/github-last-status":    "pending",
+			},
+		}}
+		rv.Spec.Containers = []v1.Container{{Name: "exec"}}
+		for i := 0; i < len(annotations); i += 2 {
+			rv.ObjectMeta.Annotations[annotations[i]] = annotations[i+1]
+		}
+		return rv
+	}
+	tests := []struct {
+		name     string
+		pod      *v1.Pod
+		deleting bool
+	}{
+		{"never seen", nil, false},
+		{"deleted by the controller", pod(), true},
+		{"not a task pod", pod("triggr.crewjam.com/github-status-context", ""), false},
+		{"cancelled", pod("triggr.crewjam.com/cancelled", "superseded by 0123456"), false},
+		{"already reported", pod("triggr.crewjam.com/github-last-status", "failure"), false},
+	}
+	for _, tt := range tests {
+		c := NewController(nil, nil, nil)
+		const key = "ci/triggr-test"
+		if tt.pod != nil {
+			c.podGone(key, tt.pod)
+			c.output[tt.pod.UID] = map[string]*tailBuffer{"exec": {Max: 10}}
+		}
+		if tt.deleting {
+			c.deleting[key] = true
+		}
+		// anything other than leaving the pod alone would need kubernetes
+		// or github, which aren't there
+		if err := c.podDeleted(context.Background(), key); err != nil {
+			t.Errorf("%s: podDeleted() = %v", tt.name, err)
+		}
+		if len(c.deleted) != 0 || len(c.deleting) != 0 || len(c.output) != 0 {
+			t.Errorf("%s: podDeleted() left state behind", tt.name)
+		}
+	}
+}